@@ -0,0 +1,34 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// activityWriter passes writes through to w and remembers when the last one
+// happened, so that a command whose output has gone quiet can be spotted.
+type activityWriter struct {
+	w    io.Writer
+	mu   sync.Mutex
+	last time.Time
+}
+
+func newActivityWriter(w io.Writer) *activityWriter {
+	return &activityWriter{w: w, last: time.Now()}
+}
+
+func (a *activityWriter) Write(p []byte) (int, error) {
+	a.mu.Lock()
+	a.last = time.Now()
+	a.mu.Unlock()
+	return a.w.Write(p)
+}
+
+// idle returns how long it has been since the last write, or since the
+// writer was created if nothing has been written yet.
+func (a *activityWriter) idle() time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return time.Since(a.last)
+}
@@ -0,0 +1,65 @@
+package main
+
+import "time"
+
+// aimd adapts how many commands each host is given at once, the way TCP
+// adapts its congestion window: the window grows by about one slot for every
+// window's worth of commands that succeed quickly, and halves whenever a
+// command can't reach the host or runs out of time there. Its methods are
+// called with the pool locked.
+type aimd struct {
+	window map[*host]float64
+	avg    map[*host]time.Duration // moving average of successful run times
+}
+
+func newAIMD() *aimd {
+	return &aimd{
+		window: make(map[*host]float64),
+		avg:    make(map[*host]time.Duration),
+	}
+}
+
+// limit returns how many commands h may run at once, capped at max.
+func (a *aimd) limit(h *host, max int) int {
+	w, ok := a.window[h]
+	if !ok {
+		w = 1
+		a.window[h] = w
+	}
+	if max > 0 && int(w) > max {
+		return max
+	}
+	return int(w)
+}
+
+// record updates the window of h after a command ran on it for elapsed,
+// never growing it past max.
+func (a *aimd) record(h *host, ok bool, elapsed time.Duration, max int) {
+	before := a.limit(h, max)
+	w := a.window[h]
+	if !ok {
+		w /= 2
+		if w < 1 {
+			w = 1
+		}
+	} else {
+		// Only grow while the host keeps up; a command that takes much longer
+		// than usual suggests the host is already saturated.
+		avg, seen := a.avg[h]
+		if !seen || elapsed <= avg*3/2 {
+			w += 1 / w
+		}
+		if max > 0 && w > float64(max) {
+			w = float64(max)
+		}
+		if !seen {
+			a.avg[h] = elapsed
+		} else {
+			a.avg[h] = (avg*7 + elapsed) / 8
+		}
+	}
+	a.window[h] = w
+	if after := a.limit(h, max); after != before {
+		logDetail("ADAPT host=%v limit=%v", h.name, after)
+	}
+}
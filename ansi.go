@@ -0,0 +1,70 @@
+package main
+
+import "io"
+
+// States of an ansiStripper between writes
+const (
+	ansiText    = iota
+	ansiEscape  // after ESC
+	ansiCharset // after ESC ( or ESC ), before the charset
+	ansiCSI     // in ESC [ ... up to a final byte
+	ansiOSC     // in ESC ] ... up to BEL or ESC \
+	ansiOSCEsc  // after ESC in an OSC
+)
+
+// An ansiStripper passes writes on to w without the ANSI escape sequences in
+// them, such as colors and cursor movement, even when a sequence is split
+// over several writes.
+type ansiStripper struct {
+	w     io.Writer
+	state int
+}
+
+func (a *ansiStripper) Write(p []byte) (int, error) {
+	out := make([]byte, 0, len(p))
+	for _, b := range p {
+		switch a.state {
+		case ansiText:
+			if b == 0x1b {
+				a.state = ansiEscape
+			} else {
+				out = append(out, b)
+			}
+		case ansiEscape:
+			switch b {
+			case '[':
+				a.state = ansiCSI
+			case ']':
+				a.state = ansiOSC
+			case '(', ')':
+				a.state = ansiCharset
+			default:
+				// A two byte sequence, like ESC 7
+				a.state = ansiText
+			}
+		case ansiCharset:
+			a.state = ansiText
+		case ansiCSI:
+			if b >= 0x40 && b <= 0x7e {
+				a.state = ansiText
+			}
+		case ansiOSC:
+			switch b {
+			case 0x07:
+				a.state = ansiText
+			case 0x1b:
+				a.state = ansiOSCEsc
+			}
+		case ansiOSCEsc:
+			if b == '\\' {
+				a.state = ansiText
+			} else {
+				a.state = ansiOSC
+			}
+		}
+	}
+	if _, err := a.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
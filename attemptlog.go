@@ -0,0 +1,67 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// What to do with the output of attempts that failed
+const (
+	failedLogsKeep   = "keep"
+	failedLogsGzip   = "gzip"
+	failedLogsDelete = "delete"
+)
+
+// checkFailedLogs validates a -failed-logs policy.
+func checkFailedLogs(policy string) error {
+	switch policy {
+	case failedLogsKeep, failedLogsGzip, failedLogsDelete:
+		return nil
+	}
+	return fmt.Errorf("unknown -failed-logs policy %q, expected keep, gzip or delete", policy)
+}
+
+// disposeFailedLog applies policy to the output file of a failed attempt,
+// returning where the output is now, or "" if it was deleted.
+func disposeFailedLog(path, policy string) (string, error) {
+	switch policy {
+	case failedLogsGzip:
+		if strings.HasSuffix(path, ".gz") {
+			// Compressed as it was written
+			return path, nil
+		}
+		if err := gzipFile(path, path+".gz"); err != nil {
+			return path, err
+		}
+		return path + ".gz", os.Remove(path)
+	case failedLogsDelete:
+		return "", os.Remove(path)
+	}
+	return path, nil
+}
+
+// gzipFile writes a gzip compressed copy of the file at src to dst.
+func gzipFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
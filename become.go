@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Environment variable to read the sudo password from
+const becomePasswordEnv = "DISGO_BECOME_PASSWORD"
+
+// becomeUser, if set, is the user remote commands run as, through sudo
+var becomeUser string
+
+// becomePassword, if set, is the password sudo asks for. It is fed to sudo on
+// its standard input so that it never shows up in a command line or a log.
+var becomePassword string
+
+// become returns command wrapped to run as becomeUser, and what to feed the
+// wrapped command on its standard input.
+func become(command string) (string, io.Reader) {
+	sudo := "sudo -u " + shellQuote(becomeUser)
+	if len(commandEnv) > 0 {
+		// sudo clears the environment otherwise
+		sudo += " --preserve-env=" + shellQuote(strings.Join(envNames(commandEnv), ","))
+	}
+	wrapped := " -- sh -c " + shellQuote(command)
+	if becomePassword == "" {
+		// Fail rather than wait for a password nobody will type
+		return sudo + " -n" + wrapped, nil
+	}
+	return sudo + " -S -p ''" + wrapped, strings.NewReader(becomePassword + "\n")
+}
+
+// checkBecomePTY returns an error if j would be fed the sudo password on a
+// pseudo-terminal, with -pty set as pty, which echoes it into the output.
+func checkBecomePTY(j *job, pty bool) error {
+	if j.pty != nil {
+		pty = *j.pty
+	}
+	if pty && becomePassword != "" {
+		return fmt.Errorf("command %v runs on a pseudo-terminal, which would echo the -become password into its output", j.id)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import "time"
+
+// A breaker keeps work away from hosts that keep failing to connect. After
+// threshold connection failures in a row the circuit of the host opens and
+// it gets no commands for the cool-down period. Then it is half-open: a single
+// command is let through as a probe, and the circuit closes if that one
+// reaches the host, or opens again if it doesn't. Its methods are called
+// with the pool locked.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+	onReopen  func() // called once a cool-down is over, to wake waiting commands
+	failures  map[*host]int
+	openUntil map[*host]time.Time
+	probing   map[*host]bool // a half-open host has its probe in flight
+}
+
+func newBreaker(threshold int, cooldown time.Duration, onReopen func()) *breaker {
+	return &breaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		onReopen:  onReopen,
+		failures:  make(map[*host]int),
+		openUntil: make(map[*host]time.Time),
+		probing:   make(map[*host]bool),
+	}
+}
+
+// blocked reports whether h may not be given a command right now.
+func (b *breaker) blocked(h *host) bool {
+	if b.failures[h] < b.threshold {
+		return false
+	}
+	return time.Now().Before(b.openUntil[h]) || b.probing[h]
+}
+
+// claimed must be called when a command is placed on h. On a half-open host
+// that command is the probe.
+func (b *breaker) claimed(h *host) {
+	if b.failures[h] >= b.threshold {
+		b.probing[h] = true
+	}
+}
+
+// record updates the circuit of h after a command did or didn't reach it.
+func (b *breaker) record(h *host, reached bool) {
+	wasOpen := b.failures[h] >= b.threshold
+	if reached {
+		if wasOpen {
+			logInfo("CIRCUIT closed host=%v", h.name)
+		}
+		delete(b.failures, h)
+		delete(b.openUntil, h)
+		delete(b.probing, h)
+		return
+	}
+	b.failures[h]++
+	if b.failures[h] < b.threshold {
+		return
+	}
+	if wasOpen && !b.probing[h] {
+		// A command placed before the circuit opened, the probe decides
+		return
+	}
+	delete(b.probing, h)
+	b.openUntil[h] = time.Now().Add(b.cooldown)
+	time.AfterFunc(b.cooldown, b.onReopen)
+	logInfo("CIRCUIT open host=%v failures=%v cooldown=%v", h.name, b.failures[h], b.cooldown)
+}
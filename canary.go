@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// runCanaries runs jobs on a single host before anything else is started, so
+// that a broken binary or command file fails once instead of on every host.
+// Each canary gets a single attempt. It returns the results once all of them
+// are done, and whether they all succeeded.
+func (d *dispatcher) runCanaries(jobs []*job) ([]*result, bool) {
+	p := d.pool
+	p.mu.Lock()
+	h := p.pick(jobs[0], make(map[*host]bool), nil)
+	p.mu.Unlock()
+	if h == nil {
+		logError("FAILED canary id=%v no host satisfies requires=%v", jobs[0].id, strings.Join(jobs[0].requires, ","))
+		return []*result{{job: jobs[0]}}, false
+	}
+	var ids []string
+	for _, j := range jobs {
+		ids = append(ids, fmt.Sprint(j.id))
+	}
+	logInfo("CANARY host=%v ids=%v", h.name, strings.Join(ids, ","))
+
+	done := make(chan *result)
+	for _, j := range jobs {
+		// Mark every other host as tried so that a failure isn't retried
+		// elsewhere
+		tried := p.allBut(h)
+		go func(j *job) {
+			done <- d.dispatch(j, tried)
+		}(j)
+	}
+	var results []*result
+	ok := true
+	for range jobs {
+		r := <-done
+		results = append(results, r)
+		ok = ok && r.ok
+	}
+	return results, ok
+}
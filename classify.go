@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/a10y/disgo/sshclient"
+	"github.com/a10y/disgo/winrm"
+)
+
+// Failure causes, so a summary can tell a sick cluster from a broken command
+const (
+	causeConnectTimeout = "connect-timeout"
+	causeAuth           = "auth"
+	causeUnreachable    = "unreachable"
+	causeExit           = "exit"
+	causeTimeout        = "timeout"
+	causeStall          = "stall"
+	causeLocalFS        = "local-fs"
+	causeChecksum       = "checksum"
+)
+
+// How much of the end of an attempt's output to keep for classifying it
+const tailSize = 4096
+
+// classify names the cause of a failed attempt from its error and the end of
+// its output, where the ssh binary prints why it couldn't connect.
+func classify(err error, tail []byte) string {
+	var authErr *sshclient.AuthError
+	var connErr *sshclient.ConnectError
+	var winrmAuthErr *winrm.AuthError
+	switch {
+	case errors.As(err, &authErr), errors.As(err, &winrmAuthErr):
+		return causeAuth
+	case errors.As(err, &connErr) && connErr.Timeout():
+		return causeConnectTimeout
+	case errors.Is(err, errLocalFS):
+		return causeLocalFS
+	case errors.Is(err, errTimedOut):
+		return causeTimeout
+	case errors.Is(err, errStalled):
+		return causeStall
+	case errors.Is(err, errChecksum):
+		return causeChecksum
+	case !unreachable(err):
+		return causeExit
+	case bytes.Contains(tail, []byte("timed out")):
+		return causeConnectTimeout
+	case bytes.Contains(tail, []byte("Permission denied")), bytes.Contains(tail, []byte("Host key verification failed")):
+		return causeAuth
+	}
+	return causeUnreachable
+}
+
+// hostFault reports whether cause is the host or the way to it failing, or
+// it being too slow, rather than the command itself.
+func hostFault(cause string) bool {
+	switch cause {
+	case causeConnectTimeout, causeAuth, causeUnreachable, causeTimeout, causeStall:
+		return true
+	}
+	return false
+}
+
+// tailBuffer is a writer that keeps the last tailSize bytes written to it.
+type tailBuffer struct {
+	buf []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > tailSize {
+		t.buf = append(t.buf[:0], t.buf[len(t.buf)-tailSize:]...)
+	}
+	return len(p), nil
+}
+
+// causeCounts tallies failures by cause.
+type causeCounts struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func newCauseCounts() *causeCounts {
+	return &causeCounts{counts: make(map[string]int)}
+}
+
+func (c *causeCounts) add(cause string) {
+	c.mu.Lock()
+	c.counts[cause]++
+	c.mu.Unlock()
+}
+
+// String lists the counts as cause=count, most common first.
+func (c *causeCounts) String() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	causes := make([]string, 0, len(c.counts))
+	for cause := range c.counts {
+		causes = append(causes, cause)
+	}
+	sort.Slice(causes, func(i, k int) bool {
+		if c.counts[causes[i]] != c.counts[causes[k]] {
+			return c.counts[causes[i]] > c.counts[causes[k]]
+		}
+		return causes[i] < causes[k]
+	})
+	var fields []string
+	for _, cause := range causes {
+		fields = append(fields, fmt.Sprintf("%v=%v", cause, c.counts[cause]))
+	}
+	return strings.Join(fields, " ")
+}
+
+// total returns the number of failures counted.
+func (c *causeCounts) total() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	total := 0
+	for _, n := range c.counts {
+		total += n
+	}
+	return total
+}
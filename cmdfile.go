@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// A commandEntry is a command in a structured commands file, with what the
+// annotations of a plain one would say as fields of its own:
+//
+//	[{"command": "./train.sh", "label": "train", "timeout": "2h",
+//	  "retries": 1, "requires": ["gpu"], "priority": 2,
+//	  "env": {"EPOCHS": "10"}}]
+//
+// or the same as a YAML list.
+type commandEntry struct {
+	Command  string            `json:"command" yaml:"command"`
+	Label    string            `json:"label,omitempty" yaml:"label"`
+	Timeout  string            `json:"timeout,omitempty" yaml:"timeout"`
+	Retries  *int              `json:"retries,omitempty" yaml:"retries"`
+	Requires []string          `json:"requires,omitempty" yaml:"requires"`
+	Priority int               `json:"priority,omitempty" yaml:"priority"`
+	Env      map[string]string `json:"env,omitempty" yaml:"env"`
+}
+
+// structuredCommands reports whether the commands file at path is JSON or
+// YAML rather than a command per line, going by its extension.
+func structuredCommands(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json", ".yaml", ".yml":
+		return true
+	}
+	return false
+}
+
+// parseCommandFile turns the entries of the structured commands file at path
+// into jobs, numbered consecutively from firstID. With a sweep, every entry
+// becomes a job for each combination of its values, filled in to the
+// command and label.
+func parseCommandFile(path string, firstID int, sweep []sweepParam) ([]*job, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []commandEntry
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&entries)
+	} else {
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(&entries)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	combos := sweepCombos(sweep)
+	jobs := make([]*job, 0, len(entries)*len(combos))
+	for n, e := range entries {
+		for _, c := range combos {
+			e := e
+			e.Command, e.Label = expandCommand(e.Command, c), expandCommand(e.Label, c)
+			j, err := e.job(firstID + len(jobs))
+			if err != nil {
+				return nil, fmt.Errorf("%v entry %v: %v", path, n+1, err)
+			}
+			j.file = path
+			jobs = append(jobs, j)
+		}
+	}
+	return jobs, nil
+}
+
+// job makes the job with the given id that runs e. Its line is e as a line
+// of a plain commands file would say it, for the journal and the failed
+// commands file.
+func (e commandEntry) job(id int) (*job, error) {
+	if strings.TrimSpace(e.Command) == "" {
+		return nil, fmt.Errorf("no command")
+	}
+	j := &job{id: id, command: e.Command}
+	var annotations []string
+	if e.Label != "" {
+		annotations = append(annotations, "label="+e.Label)
+	}
+	if e.Timeout != "" {
+		annotations = append(annotations, "timeout="+e.Timeout)
+	}
+	if e.Retries != nil {
+		annotations = append(annotations, fmt.Sprintf("retries=%v", *e.Retries))
+	}
+	if len(e.Requires) > 0 {
+		annotations = append(annotations, "requires="+strings.Join(e.Requires, ","))
+	}
+	if e.Priority != 0 {
+		annotations = append(annotations, fmt.Sprintf("priority=%v", e.Priority))
+	}
+	var line strings.Builder
+	for _, a := range annotations {
+		if strings.ContainsAny(a, " \t") {
+			return nil, fmt.Errorf("%q can't have spaces in it", a)
+		}
+		if err := j.annotate(a); err != nil {
+			return nil, err
+		}
+		line.WriteString("#" + a + " ")
+	}
+	keys := make([]string, 0, len(e.Env))
+	for k := range e.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		kv := k + "=" + e.Env[k]
+		if err := checkEnv(kv); err != nil {
+			return nil, err
+		}
+		j.env = append(j.env, kv)
+	}
+	// The variables go in front of the command, as no annotation sets them
+	line.WriteString(withEnv(&host{}, j.env, j.command))
+	j.line = line.String()
+	return j, nil
+}
+
+// withEnv returns command prefixed to set the variables in env first on h.
+func withEnv(h *host, env []string, command string) string {
+	if len(env) == 0 {
+		return command
+	}
+	var b strings.Builder
+	for _, kv := range env {
+		k, v, _ := strings.Cut(kv, "=")
+		if h.winrm != "" {
+			fmt.Fprintf(&b, "set \"%v=%v\" && ", k, v)
+		} else {
+			fmt.Fprintf(&b, "export %v=%v && ", k, shellQuote(v))
+		}
+	}
+	return b.String() + command
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A job is a single line of the commands file waiting to be dispatched. A
+// line may start with #key=value annotations that tell disgo how to place the
+// command, e.g. "#group=alpha #priority=2 ./stage.sh alpha". Lines starting
+// with % are directives rather than commands, e.g. "%queue io limit=4" or
+// "%include more.txt".
+type job struct {
+	id       int
+	file     string // commands file the job came from
+	command  string
+	line     string // the line as written, annotations included
+	group    string // commands sharing a group prefer to run on the same host
+	priority int    // higher priorities are dispatched first
+	requires []string
+	duration time.Duration // expected run time, if the user gave a hint
+	queue    string        // named queue whose limits the job counts against
+	gang     string        // commands of a gang start together on distinct hosts
+	prefers  []string      // labels or host names to try before any other host
+	timeout  time.Duration // overrides -timeout for this command
+	chdir    string        // overrides -chdir for this command
+	pty      *bool         // overrides -pty for this command if set
+	label    string        // names the command in logs, paths and reports besides its id
+	sha256   string        // expected SHA-256 of the command's stdout
+	retries  *int          // overrides -retries for this command if set
+	env      []string      // KEY=VALUE pairs set for this command on top of -env
+	script   []byte        // for -scripts, the local script the command names
+	attempts int           // attempts made so far, over every pass
+}
+
+// queueLimit caps how many commands of a named queue run at once, across the
+// whole run and on any single host. Zero means no cap.
+type queueLimit struct {
+	total   int
+	perHost int
+}
+
+// parseCommands turns the lines of the commands file at path into jobs,
+// numbered consecutively from firstID. Queues declared by the file are added
+// to queues. With a sweep, every command line becomes a job for each
+// combination of its values. Blank lines and comments are skipped, and
+// %include lines parsed in place of the file they name.
+func parseCommands(path string, lines []string, firstID int, queues map[string]queueLimit, sweep []sweepParam) ([]*job, error) {
+	return parseCommandsAt(path, 1, lines, firstID, queues, sweep)
+}
+
+// parseCommandsAt is parseCommands for lines of the file starting at line
+// number firstLine, for errors to say where they are.
+func parseCommandsAt(path string, firstLine int, lines []string, firstID int, queues map[string]queueLimit, sweep []sweepParam) ([]*job, error) {
+	return parseCommandLines(path, firstLine, lines, firstID, queues, sweepCombos(sweep), nil)
+}
+
+// parseCommandLines does the work of parseCommandsAt, with included holding
+// the files being included on the way to path.
+func parseCommandLines(path string, firstLine int, lines []string, firstID int, queues map[string]queueLimit, combos []map[string]string, included []string) ([]*job, error) {
+	jobs := make([]*job, 0, len(lines))
+	for i, line := range lines {
+		n := firstLine + i - 1
+		if isComment(line) {
+			continue
+		}
+		if inc, ok := includeDirective(path, line); ok {
+			incLines, stack, err := readInclude(inc, path, included)
+			if err != nil {
+				return nil, fmt.Errorf("%v line %v: %v", path, n+1, err)
+			}
+			incJobs, err := parseCommandLines(inc, 1, incLines, firstID+len(jobs), queues, combos, stack)
+			if err != nil {
+				return nil, err
+			}
+			for _, j := range incJobs {
+				// Shared out with the rest of the file, as if written in it
+				j.file = path
+			}
+			jobs = append(jobs, incJobs...)
+			continue
+		}
+		if strings.HasPrefix(line, "%") {
+			if err := parseDirective(line[1:], queues); err != nil {
+				return nil, fmt.Errorf("%v line %v: %v", path, n+1, err)
+			}
+			continue
+		}
+		for _, c := range combos {
+			j, err := parseCommandLine(expandCommand(line, c), firstID+len(jobs), path)
+			if err != nil {
+				return nil, fmt.Errorf("%v line %v: %v", path, n+1, err)
+			}
+			jobs = append(jobs, j)
+		}
+	}
+	return jobs, nil
+}
+
+// parseCommandLine makes the job with the given id of a line of the commands
+// file at path: its annotations, then the command.
+func parseCommandLine(line string, id int, path string) (*job, error) {
+	j := &job{id: id, file: path, line: line}
+	rest := strings.TrimLeft(line, " \t")
+	for strings.HasPrefix(rest, "#") {
+		field := rest
+		if end := strings.IndexAny(rest, " \t"); end >= 0 {
+			field, rest = rest[:end], strings.TrimLeft(rest[end:], " \t")
+		} else {
+			rest = ""
+		}
+		if err := j.annotate(field[1:]); err != nil {
+			return nil, err
+		}
+	}
+	j.command = rest
+	return j, nil
+}
+
+// isComment reports whether a line of a commands file is blank or a comment:
+// a # not followed by a key=value annotation, as in "# build the indexes".
+func isComment(line string) bool {
+	fields := strings.Fields(line)
+	return len(fields) == 0 || strings.HasPrefix(fields[0], "#") && !strings.Contains(fields[0], "=")
+}
+
+// logID returns how log messages name the job after id=: its id, followed by
+// its label if it has one.
+func (j *job) logID() string {
+	if j.label == "" {
+		return strconv.Itoa(j.id)
+	}
+	return fmt.Sprintf("%v label=%v", j.id, j.label)
+}
+
+// annotate applies a single key=value annotation to the job.
+func (j *job) annotate(field string) error {
+	kv := strings.SplitN(field, "=", 2)
+	if len(kv) != 2 {
+		return fmt.Errorf("malformed annotation %q, expected #key=value", field)
+	}
+	key, value := kv[0], kv[1]
+	switch key {
+	case "group":
+		j.group = value
+	case "priority":
+		priority, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("priority must be an integer, got %q", value)
+		}
+		j.priority = priority
+	case "requires":
+		requires, err := parseTagList(value)
+		if err != nil {
+			return err
+		}
+		j.requires = append(j.requires, requires...)
+	case "duration":
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration < 0 {
+			return fmt.Errorf("duration must be a positive duration like 90s, got %q", value)
+		}
+		j.duration = duration
+	case "timeout":
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("timeout must be a positive duration like 10m, got %q", value)
+		}
+		j.timeout = timeout
+	case "chdir":
+		if value == "" {
+			return fmt.Errorf("chdir needs a directory")
+		}
+		j.chdir = value
+	case "pty":
+		pty, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("pty must be true or false, got %q", value)
+		}
+		j.pty = &pty
+	case "label":
+		if value == "" {
+			return fmt.Errorf("label can't be empty")
+		}
+		j.label = value
+	case "sha256":
+		sum, err := hex.DecodeString(value)
+		if err != nil || len(sum) != sha256.Size {
+			return fmt.Errorf("sha256 must be 64 hex digits, got %q", value)
+		}
+		j.sha256 = hex.EncodeToString(sum)
+	case "retries":
+		retries, err := strconv.Atoi(value)
+		if err != nil || retries < -1 {
+			return fmt.Errorf("retries must be -1 or more, got %q", value)
+		}
+		j.retries = &retries
+	case "queue":
+		j.queue = value
+	case "gang":
+		j.gang = value
+	case "prefers":
+		prefers, err := parseTagList(value)
+		if err != nil {
+			return err
+		}
+		j.prefers = append(j.prefers, prefers...)
+	case "data":
+		// host:/path, the data lives on that host
+		i := strings.Index(value, ":")
+		if i <= 0 {
+			return fmt.Errorf("data must look like host:/path, got %q", value)
+		}
+		j.prefers = append(j.prefers, value[:i])
+	default:
+		return fmt.Errorf("unknown annotation %q", key)
+	}
+	return nil
+}
+
+// directive formats the %queue line that declares the queue name with limits
+// q, without the leading %.
+func (q queueLimit) directive(name string) string {
+	line := "queue " + name
+	if q.total > 0 {
+		line += fmt.Sprintf(" limit=%v", q.total)
+	}
+	if q.perHost > 0 {
+		line += fmt.Sprintf(" per-host=%v", q.perHost)
+	}
+	return line
+}
+
+// parseDirective applies a directive line, without its leading %.
+//
+//	%queue <name> [limit=N] [per-host=N]
+//
+// declares a named queue that runs at most limit commands at once in total,
+// and at most per-host commands at once on any single host.
+func parseDirective(line string, queues map[string]queueLimit) error {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return fmt.Errorf("empty directive")
+	}
+	switch fields[0] {
+	case "include":
+		return fmt.Errorf("%%include needs a single file")
+	case "queue":
+		if len(fields) < 2 {
+			return fmt.Errorf("%%queue needs a name")
+		}
+		var limit queueLimit
+		for _, field := range fields[2:] {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				return fmt.Errorf("malformed queue option %q, expected key=value", field)
+			}
+			n, err := strconv.Atoi(kv[1])
+			if err != nil || n < 1 {
+				return fmt.Errorf("%v must be a positive integer, got %q", kv[0], kv[1])
+			}
+			switch kv[0] {
+			case "limit":
+				limit.total = n
+			case "per-host":
+				limit.perHost = n
+			default:
+				return fmt.Errorf("unknown queue option %q", kv[0])
+			}
+		}
+		queues[fields[1]] = limit
+	default:
+		return fmt.Errorf("unknown directive %%%v", fields[0])
+	}
+	return nil
+}
+
+// longestFirst sorts jobs by their expected duration, longest first, keeping
+// file order between jobs with the same hint.
+func longestFirst(jobs []*job) {
+	sort.SliceStable(jobs, func(i, k int) bool {
+		return jobs[i].duration > jobs[k].duration
+	})
+}
+
+// expandCommand replaces the {name} placeholders in command that vars has a
+// value for, e.g. {host} or {attempt}, so a command can name scratch dirs and
+// files after where and when it runs. Anything else in braces is left alone,
+// as is ${name}, which the shell expands.
+func expandCommand(command string, vars map[string]string) string {
+	var b strings.Builder
+	for {
+		start := strings.IndexByte(command, '{')
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(command[start:], '}')
+		if end < 0 {
+			break
+		}
+		end += start
+		value, ok := vars[command[start+1:end]]
+		if !ok || (start > 0 && command[start-1] == '$') {
+			b.WriteString(command[:start+1])
+			command = command[start+1:]
+			continue
+		}
+		b.WriteString(command[:start])
+		b.WriteString(value)
+		command = command[end+1:]
+	}
+	b.WriteString(command)
+	return b.String()
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// describeJob formats where a job came from and what the commands file said
+// about it, for tests to compare.
+func describeJob(j *job) string {
+	return fmt.Sprintf("%v %q group=%v priority=%v label=%v requires=%v", j.id, j.command, j.group, j.priority, j.label, strings.Join(j.requires, ","))
+}
+
+func TestParseCommands(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		want  []string // describeJob of every job
+	}{
+		{"plain commands", []string{"echo a", "echo b"}, []string{
+			`5 "echo a" group= priority=0 label= requires=`,
+			`6 "echo b" group= priority=0 label= requires=`,
+		}},
+		{"blank lines and comments", []string{"", "# build the indexes", "   ", "\t# indented", "echo a # stays in the command"}, []string{
+			`5 "echo a # stays in the command" group= priority=0 label= requires=`,
+		}},
+		{"annotations", []string{"#group=alpha #priority=2 ./stage.sh alpha"}, []string{
+			`5 "./stage.sh alpha" group=alpha priority=2 label= requires=`,
+		}},
+		{"indented annotations", []string{"  #label=idx\t#requires=gpu,ssd   make  index"}, []string{
+			`5 "make  index" group= priority=0 label=idx requires=gpu,ssd`,
+		}},
+		{"only at the start", []string{"echo #group=alpha"}, []string{
+			`5 "echo #group=alpha" group= priority=0 label= requires=`,
+		}},
+		{"directives are no commands", []string{"%queue io limit=2", "echo a"}, []string{
+			`5 "echo a" group= priority=0 label= requires=`,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jobs, err := parseCommands("cmds", tt.lines, 5, map[string]queueLimit{}, nil)
+			if err != nil {
+				t.Fatalf("parseCommands(%q) = %v", tt.lines, err)
+			}
+			var got []string
+			for _, j := range jobs {
+				got = append(got, describeJob(j))
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("parseCommands(%q) =\n%v\nwant\n%v", tt.lines, strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestParseCommandsErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		want  string
+	}{
+		{"bad priority", []string{"echo a", "", "#priority=high echo b"}, `cmds line 3: priority must be an integer, got "high"`},
+		{"unknown annotation", []string{"#speed=fast echo"}, `cmds line 1: unknown annotation "speed"`},
+		{"bad timeout", []string{"#timeout=0s echo"}, "timeout must be a positive duration"},
+		{"bad sha256", []string{"#sha256=abc echo"}, "sha256 must be 64 hex digits"},
+		{"bad data", []string{"#data=/scratch echo"}, "data must look like host:/path"},
+		{"empty directive", []string{"%"}, "cmds line 1: empty directive"},
+		{"unknown directive", []string{"%repeat 3"}, "unknown directive %repeat"},
+		{"queue without a name", []string{"%queue"}, "%queue needs a name"},
+		{"bad queue limit", []string{"%queue io limit=0"}, `limit must be a positive integer, got "0"`},
+		{"unknown queue option", []string{"%queue io size=2"}, `unknown queue option "size"`},
+		{"include without a file", []string{"%include"}, "cmds line 1: %include needs a single file"},
+		{"include of two files", []string{"%include a b"}, "%include needs a single file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseCommands("cmds", tt.lines, 0, map[string]queueLimit{}, nil); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("parseCommands(%q) = %v, want an error with %q", tt.lines, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCommandsAtLineNumbers(t *testing.T) {
+	_, err := parseCommandsAt("cmds", 10, []string{"echo a", "#bogus=1 echo b"}, 0, map[string]queueLimit{}, nil)
+	if err == nil || !strings.HasPrefix(err.Error(), "cmds line 11:") {
+		t.Errorf("parseCommandsAt(cmds, 10, ...) = %v, want an error on line 11", err)
+	}
+}
+
+func TestParseCommandsQueues(t *testing.T) {
+	queues := map[string]queueLimit{}
+	lines := []string{"%queue io limit=4 per-host=1", "%queue net", "%queue cpu per-host=2"}
+	if _, err := parseCommands("cmds", lines, 0, queues, nil); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]queueLimit{"io": {4, 1}, "net": {}, "cpu": {0, 2}}
+	if len(queues) != len(want) {
+		t.Fatalf("queues = %v, want %v", queues, want)
+	}
+	for name, q := range want {
+		if queues[name] != q {
+			t.Errorf("queue %v = %+v, want %+v", name, queues[name], q)
+		}
+	}
+}
+
+func TestParseCommandsSweep(t *testing.T) {
+	sweep := []sweepParam{{"n", []string{"1", "2"}}, {"mode", []string{"fast", "slow"}}}
+	lines := []string{"# one job per combination", "run {n} {mode} {host}"}
+	jobs, err := parseCommands("cmds", lines, 0, map[string]queueLimit{}, sweep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"run 1 fast {host}", "run 1 slow {host}", "run 2 fast {host}", "run 2 slow {host}"}
+	if len(jobs) != len(want) {
+		t.Fatalf("parsed %v jobs, want %v", len(jobs), len(want))
+	}
+	for i, j := range jobs {
+		if j.id != i || j.command != want[i] {
+			t.Errorf("job %v = %v %q, want %v %q", i, j.id, j.command, i, want[i])
+		}
+	}
+}
+
+func TestParseCommandsInclude(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		lines []string
+		want  []string // commands
+		err   string   // regexp the error matches, if there is one
+	}{
+		{
+			name:  "in place of the line",
+			files: map[string]string{"more.txt": "# fragment\necho b\necho c\n"},
+			lines: []string{"echo a", "%include more.txt", "echo d"},
+			want:  []string{"echo a", "echo b", "echo c", "echo d"},
+		},
+		{
+			name:  "relative to the including file",
+			files: map[string]string{"sub/one.txt": "echo b\n%include two.txt\n", "sub/two.txt": "echo c\n"},
+			lines: []string{"echo a", "%include sub/one.txt"},
+			want:  []string{"echo a", "echo b", "echo c"},
+		},
+		{
+			name:  "missing file",
+			lines: []string{"echo a", "%include gone.txt"},
+			err:   `cmds line 2: .*gone\.txt`,
+		},
+		{
+			name:  "including itself",
+			files: map[string]string{"loop.txt": "echo a\n%include loop.txt\n"},
+			lines: []string{"%include loop.txt"},
+			err:   `loop\.txt line 2: %include of .*loop\.txt includes itself`,
+		},
+		{
+			name:  "a cycle",
+			files: map[string]string{"one.txt": "%include two.txt\n", "two.txt": "%include one.txt\n"},
+			lines: []string{"%include one.txt"},
+			err:   `two\.txt line 1: %include of .*one\.txt includes itself`,
+		},
+		{
+			name:  "errors name the included file",
+			files: map[string]string{"more.txt": "echo a\n#priority=x echo b\n"},
+			lines: []string{"%include more.txt"},
+			err:   `more\.txt line 2: priority must be an integer`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeFiles(t, tt.files)
+			path := filepath.Join(dir, "cmds")
+			jobs, err := parseCommands(path, tt.lines, 0, map[string]queueLimit{}, nil)
+			if tt.err != "" {
+				if err == nil || !regexp.MustCompile(tt.err).MatchString(err.Error()) {
+					t.Errorf("parseCommands(%q) = %v, want an error matching %q", tt.lines, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseCommands(%q) = %v", tt.lines, err)
+			}
+			if len(jobs) != len(tt.want) {
+				t.Fatalf("parsed %v jobs, want %v", len(jobs), len(tt.want))
+			}
+			for i, j := range jobs {
+				if j.id != i || j.command != tt.want[i] || j.file != path {
+					t.Errorf("job %v = %v %q from %v, want %v %q from %v", i, j.id, j.command, j.file, i, tt.want[i], path)
+				}
+			}
+		})
+	}
+}
+
+// Queues declared in an included file count for the whole run, and a sweep
+// applies to included commands too.
+func TestParseCommandsIncludeQueuesAndSweep(t *testing.T) {
+	dir := writeFiles(t, map[string]string{"more.txt": "%queue io limit=2\n#queue=io copy {n}\n"})
+	queues := map[string]queueLimit{}
+	sweep := []sweepParam{{"n", []string{"1", "2"}}}
+	jobs, err := parseCommands(filepath.Join(dir, "cmds"), []string{"%include more.txt"}, 0, queues, sweep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if queues["io"].total != 2 {
+		t.Errorf("queues = %v, want io with limit 2", queues)
+	}
+	if len(jobs) != 2 || jobs[0].command != "copy 1" || jobs[1].command != "copy 2" || jobs[1].queue != "io" {
+		t.Errorf("parsed %v jobs, want copy 1 and copy 2 in queue io", len(jobs))
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"sort"
+)
+
+// writeFailed writes the lines of the failed jobs to path, in id order and
+// annotations included, so that the file can be given back to -cmds once the
+// problem is fixed. The %queue lines the jobs need come first. If nothing
+// failed, a file left over from an earlier run is removed instead, unless it
+// is one of inputs, the commands files it was given back as.
+func writeFailed(path string, failed []*job, queues map[string]queueLimit, inputs []string) error {
+	if len(failed) == 0 {
+		if oneOf(path, inputs) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	sort.Slice(failed, func(i, k int) bool {
+		return failed[i].id < failed[k].id
+	})
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	declared := make(map[string]bool)
+	for _, j := range failed {
+		if j.queue != "" && !declared[j.queue] {
+			declared[j.queue] = true
+			w.WriteString("%" + queues[j.queue].directive(j.queue) + "\n")
+		}
+	}
+	for _, j := range failed {
+		w.WriteString(j.line + "\n")
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	logInfo("FAILED commands written to %v", path)
+	return f.Close()
+}
+
+// oneOf reports whether the file at path is also at one of paths.
+func oneOf(path string, paths []string) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	for _, p := range paths {
+		if other, err := os.Stat(p); err == nil && os.SameFile(info, other) {
+			return true
+		}
+	}
+	return false
+}
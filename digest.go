@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// logDigest logs the last n lines of stderr of the last attempt of every
+// command in s that failed, so what broke can be seen without opening their
+// output files. With the output combined, the lines are the last of it. It
+// logs at the error level, for -q to keep the digest.
+func logDigest(t outputTree, s *runSummary, n int) {
+	if n <= 0 {
+		return
+	}
+	for _, c := range s.Commands {
+		if c.Status == "succeeded" || c.Output == "" {
+			continue
+		}
+		m, err := t.readCommandMeta(c.ID)
+		if err != nil {
+			continue
+		}
+		last := m.Attempts[len(m.Attempts)-1]
+		if last.Stderr == "" {
+			logError("DIGEST id=%v host=%v cause=%v command=%q: its output was not kept", c.ID, c.Host, c.Cause, c.Command)
+			continue
+		}
+		lines, err := lastLines(filepath.Join(c.Output, last.Stderr), n)
+		switch {
+		case err != nil:
+			logError("ERROR could not read the output of id=%v for the digest: %v", c.ID, err)
+		case len(lines) == 0:
+			logError("DIGEST id=%v host=%v cause=%v command=%q: nothing on %v", c.ID, c.Host, c.Cause, c.Command, strings.TrimSuffix(last.Stderr, ".gz"))
+		default:
+			logError("DIGEST id=%v host=%v cause=%v command=%q, last lines of %v:\n    %v", c.ID, c.Host, c.Cause, c.Command, strings.TrimSuffix(last.Stderr, ".gz"), strings.Join(lines, "\n    "))
+		}
+	}
+}
+
+// lastLines returns the last n lines of the output file at path, which may be
+// gzipped.
+func lastLines(path string, n int) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		r = zr
+	}
+	br := bufio.NewReader(r)
+	lines := make([]string, 0, n)
+	for {
+		line, err := br.ReadString('\n')
+		if line = strings.TrimRight(line, "\r\n"); line != "" || err == nil {
+			if len(lines) == n {
+				lines = append(lines[:0], lines[1:]...)
+			}
+			lines = append(lines, line)
+		}
+		if err == io.EOF {
+			return lines, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
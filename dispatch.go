@@ -0,0 +1,536 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/a10y/disgo/scheduler"
+)
+
+// Errors for attempts disgo stopped itself
+var (
+	errTimedOut = errors.New("timed out")
+	errStalled  = errors.New("stalled")
+	errLocalFS  = errors.New("local file system error")
+	errChecksum = errors.New("output checksum mismatch")
+)
+
+// unreachable reports whether err from tryCommand means the command never
+// got to run on the host, as opposed to the command itself failing.
+func unreachable(err error) bool {
+	if errors.Is(err, errTimedOut) || errors.Is(err, errStalled) || errors.Is(err, errChecksum) {
+		return false
+	}
+	var exitErr *commandExitError
+	if errors.As(err, &exitErr) {
+		return false
+	}
+	return err != nil
+}
+
+// exitCode returns the exit status of the remote command from an error
+// returned by tryCommand, or -1 if it didn't exit normally.
+func exitCode(err error) int {
+	var exitErr *commandExitError
+	if errors.As(err, &exitErr) {
+		return int(exitErr.status)
+	}
+	return -1
+}
+
+// A result is what the dispatcher reports back once it is done with a job.
+type result struct {
+	job        *job
+	ok         bool
+	failedFast bool   // gave up without trying every host because the attempt budget ran out
+	permanent  bool   // exited with a status that is not worth retrying
+	undone     bool   // not run to the end because the pool was shut down
+	host       *host  // where the last attempt ran, nil if there was none
+	err        error  // what the last attempt failed with
+	cause      string // what the failure was put down to, see classify
+}
+
+// A dispatcher runs jobs taken off the queue on hosts from the pool and
+// reports every job's result.
+type dispatcher struct {
+	pool     *hostPool
+	limiter  *scheduler.TokenBucket // if set, paces how fast jobs are started
+	budget   *attemptBudget         // if set, caps attempts across the whole run
+	retries  int                    // failed runs of a job to retry, negative to try every host
+	backoff  scheduler.Backoff      // how long to wait before each retry
+	sameHost int                    // times to retry a failed job on the same host before moving on
+	perHost  int                    // most attempts of a job on any one host, 0 for no cap
+	// retryCodes, if set, are the only exit statuses that get a command
+	// retried
+	retryCodes map[int]bool
+	results    chan *result
+	// stoppable wraps remote commands so that they can be killed early,
+	// which preemption needs. Commands with a timeout are always wrapped.
+	stoppable bool
+	timeout   time.Duration // how long an attempt may run, 0 for no limit
+	stall     time.Duration // how long an attempt may go without output, 0 for no limit
+	chdir     string        // remote directory commands run in, created if missing
+	output    outputTree    // where the output of every attempt goes
+	pty       bool          // run commands on a pseudo-terminal
+	stream    bool          // also print output to the terminal as it comes
+	tee       bool          // same, without prefixing lines
+	onFailure string        // local command to run for every command that fails for good
+	journal   *journal
+	events    *eventLog
+	// failedLogs says what to do with the output of failed attempts: keep,
+	// gzip or delete it
+	failedLogs string
+	causes     *causeCounts // of every failed attempt
+	// keepAttempts keeps the output of the failed attempts of commands that
+	// went on to succeed, which otherwise is removed, or with
+	// archiveAttempts archived first
+	keepAttempts    bool
+	archiveAttempts bool
+	// template says where else the output of commands that succeed goes,
+	// if anywhere
+	template outputTemplate
+	// merged, if set, gets every line of output of every attempt as it
+	// ends, timestamped and prefixed with where it came from
+	merged io.Writer
+	// uploads copies the metadata and the output of the last attempt of
+	// every command to object storage once the command is done with
+	uploads *uploader
+	// hostLogs, if set, gets every attempt appended to the log of the host
+	// it ran on
+	hostLogs *hostLogs
+	// safeQuoting sends commands base64-encoded for -quote safe
+	safeQuoting bool
+}
+
+// Pull jobs off the queue and dispatch them one at a time until the queue is
+// closed, waiting on the rate limiter first if there is one.
+func (d *dispatcher) worker(queue *scheduler.Queue) {
+	for {
+		v, ok := queue.Pop()
+		if !ok {
+			return
+		}
+		if d.pool.isShutdown() {
+			d.results <- &result{job: v.(*job), undone: true}
+			continue
+		}
+		if d.limiter != nil {
+			d.limiter.Wait()
+		}
+		d.results <- d.dispatch(v.(*job), make(map[*host]bool))
+	}
+}
+
+// Dispatch a given command to one of a set of available servers. If the command fails,
+// attempt to try it again on a different server. Hosts already in tried are
+// never used.
+func (d *dispatcher) dispatch(j *job, tried map[*host]bool) (r *result) {
+	id := j.id
+	var last *host
+	var lastErr error
+	lastCause := ""
+	attempted := j.attempts // before this pass
+	defer func() {
+		r.host, r.err = last, lastErr
+		if err := d.output.writeCommandMeta(id, j.command, r.ok); err != nil {
+			logError("ERROR id=%v could not write the metadata of the command: %v", j.logID(), err)
+		}
+		if j.attempts > attempted {
+			// Resumed and requeued commands were uploaded when they ran
+			d.uploads.upload(filepath.Join(d.output.commandDir(id), "meta.json"))
+			d.uploads.uploadDir(d.output.attemptDir(id, j.attempts-1))
+		}
+		if !r.ok {
+			r.cause = lastCause
+		}
+		if !r.ok && !r.undone {
+			d.journal.record(j, stateFailed, last, j.attempts-1)
+			e := event{Event: eventGaveUp, ID: id, Label: j.label, Attempt: j.attempts - 1, Cause: lastCause}
+			if last != nil {
+				e.Host = last.name
+			}
+			if lastErr != nil {
+				e.Error = lastErr.Error()
+			}
+			d.events.emit(e)
+		}
+		if !r.ok && !r.undone && d.onFailure != "" {
+			d.runFailureHook(r)
+		}
+	}()
+	// Try hosts in the order the pool picks them until one works. The pool
+	// waits for a free slot on the host before handing it out.
+	failures := 0
+	var retryOn *host // host to retry on, if any
+	sameHost := 0     // retries made on retryOn
+	onHost := make(map[*host]int)
+	for attempts := j.attempts; ; attempts++ {
+		if retries := d.retriesOf(j); retries >= 0 && failures > retries {
+			logError("FAILED id=%v retries exhausted after %v failed attempts", j.logID(), failures)
+			return &result{job: j}
+		}
+		if !d.budget.take() {
+			logError("FAILED id=%v attempt budget exhausted after %v attempts", j.logID(), attempts)
+			return &result{job: j, failedFast: true}
+		}
+		// Write out an attempt file for this command
+		attemptDir := d.output.attemptDir(id, attempts)
+		out, err := d.output.createOutput(id, attempts)
+		if err != nil {
+			// Likely the FS is damaged or out of space, which no host can fix
+			d.budget.refund()
+			lastErr, lastCause = fmt.Errorf("%w: %v", errLocalFS, err), causeLocalFS
+			d.causes.add(causeLocalFS)
+			logError("FAILED id=%v could not create the output of %v: %v", j.logID(), attemptDir, err)
+			return &result{job: j}
+		}
+		if j.label != "" {
+			if err := d.output.linkLabel(id, j.label); err != nil {
+				logError("ERROR id=%v could not link the output to its label: %v", j.logID(), err)
+			}
+		}
+		where := tried
+		if retryOn != nil {
+			where = d.pool.allBut(retryOn)
+		}
+		c := d.pool.acquire(j, where)
+		if c == nil {
+			d.budget.refund()
+			out.close()
+			os.RemoveAll(attemptDir)
+			if d.pool.isShutdown() {
+				logInfo("FAILED id=%v the run is shutting down", j.logID())
+				return &result{job: j, undone: true}
+			}
+			break
+		}
+		h := c.host
+		j.attempts = attempts + 1
+		d.journal.record(j, stateRunning, h, attempts)
+		logDetail("EXEC command id=%v host=%v", j.logID(), h.name)
+		started := time.Now()
+		d.events.emit(event{Time: started, Event: eventStarted, ID: id, Label: j.label, Attempt: attempts, Host: h.name})
+		tail := &tailBuffer{}
+		// ssh says why it couldn't connect on stderr
+		stdout, stderr := io.Writer(out.stdout), io.Writer(io.MultiWriter(out.stderr, tail))
+		var streams []*lineStreamer
+		if d.stream {
+			streams = []*lineStreamer{newLineStreamer(os.Stdout, j, h), newLineStreamer(os.Stderr, j, h)}
+			stdout, stderr = io.MultiWriter(stdout, streams[0]), io.MultiWriter(stderr, streams[1])
+		} else if d.tee {
+			stdout, stderr = io.MultiWriter(stdout, terminalWriter{os.Stdout}), io.MultiWriter(stderr, terminalWriter{os.Stderr})
+		}
+		if d.merged != nil {
+			merged := []*lineStreamer{newLineStreamer(d.merged, j, h), newLineStreamer(d.merged, j, h)}
+			for _, s := range merged {
+				s.timestamps = true
+			}
+			stdout, stderr = io.MultiWriter(stdout, merged[0]), io.MultiWriter(stderr, merged[1])
+			streams = append(streams, merged...)
+		}
+		err = d.run(j, c, attempts, stdout, stderr)
+		for _, s := range streams {
+			s.flush()
+		}
+		closeErr := out.close()
+		exited := err == nil || exitCode(err) >= 0
+		if err == nil && j.sha256 != "" {
+			if sum := out.stdout.checksum(); sum != j.sha256 {
+				err = fmt.Errorf("%w: stdout has sha256 %v, expected %v", errChecksum, sum, j.sha256)
+			}
+		}
+		preempted := c.isPreempted()
+		last, lastErr = h, err
+		if err != nil && !preempted {
+			lastCause = classify(err, tail.buf)
+			d.causes.add(lastCause)
+		}
+		onHost[h]++
+		d.pool.release(j, h, err == nil || preempted, lastCause, time.Since(started))
+		d.pool.reached(h, preempted || !unreachable(err))
+		meta := &attemptMeta{
+			ID:       id,
+			Label:    j.label,
+			Command:  j.command,
+			Host:     h.name,
+			Attempt:  attempts,
+			Started:  started,
+			Finished: time.Now(),
+			OK:       err == nil && !preempted,
+		}
+		meta.Duration = meta.Finished.Sub(started).Seconds()
+		if exited {
+			code := max(exitCode(err), 0)
+			meta.Exit = &code
+		}
+		if err != nil {
+			meta.Error, meta.Cause = err.Error(), lastCause
+		} else if preempted {
+			meta.Error = "preempted"
+		}
+		out.record(meta)
+		if err := closeErr; err != nil {
+			logError("ERROR id=%v could not finish writing the output of attempt %v: %v", j.logID(), attempts, err)
+		}
+		if err := d.hostLogs.add(meta, attemptDir, out); err != nil {
+			logError("ERROR id=%v could not write to the log of host %v: %v", j.logID(), h.name, err)
+		}
+		if err != nil || preempted {
+			if err := out.dispose(d.failedLogs, meta); err != nil {
+				logError("ERROR id=%v %v", j.logID(), err)
+			}
+		}
+		if err := d.output.writeMeta(meta); err != nil {
+			logError("ERROR id=%v could not write the metadata of attempt %v: %v", j.logID(), attempts, err)
+		}
+		switch {
+		case preempted:
+			d.events.ended(eventPreempted, meta)
+		case err != nil:
+			d.events.ended(eventFailed, meta)
+		default:
+			d.events.ended(eventSucceeded, meta)
+		}
+		if preempted {
+			// Go back into line for any host, this one included
+			logDetail("REQUEUE id=%v preempted on host=%v", j.logID(), h.name)
+			if d.perHost <= 0 || onHost[h] < d.perHost {
+				delete(tried, h)
+			}
+			continue
+		}
+		if unreachable(err) {
+			// Says nothing about the command, so move on to another host
+			// without spending a retry
+			logDetail("UNREACHABLE id=%v host=%v status=%v", j.logID(), h.name, err)
+			retryOn = nil
+			sameHost = 0
+			continue
+		}
+		if err != nil {
+			logDetail("ERROR id=%v status=%v", j.logID(), err)
+			if code := exitCode(err); d.retryCodes != nil && code >= 0 && !d.retryCodes[code] {
+				logError("FAILED id=%v exit status %v is permanent, not retrying", j.logID(), code)
+				return &result{job: j, permanent: true}
+			}
+			failures++
+			retryOn = nil
+			if sameHost < d.sameHost && (d.perHost <= 0 || onHost[h] < d.perHost) {
+				sameHost++
+				retryOn = h
+			} else {
+				sameHost = 0
+			}
+			if delay := d.backoff.Delay(failures); delay > 0 && d.retrying(j, tried, retryOn, failures) {
+				logDetail("BACKOFF id=%v retrying in %v", j.logID(), delay)
+				time.Sleep(delay)
+			}
+			continue
+		}
+		// If successful, atomically point the final link at the attempt
+		if err := d.output.markFinal(id, attempts); err != nil {
+			// FS errors can be hard to recover from. Instead of failing,
+			// just print an error and move on
+			logError("ERROR (id=%v): could not mark attempt %v final, output in %v: %v", j.logID(), attempts, attemptDir, err)
+		}
+		if d.template != "" {
+			if err := d.output.publish(d.template, j, h, attempts, out); err != nil {
+				logError("ERROR id=%v could not put the output where -output says: %v", j.logID(), err)
+			}
+		}
+		if !d.keepAttempts {
+			if err := d.output.cleanAttempts(id, attempts, d.archiveAttempts); err != nil {
+				logError("ERROR id=%v could not clean up the output of earlier attempts: %v", j.logID(), err)
+			}
+		}
+		logDetail("SUCC id=%v output=%v", j.logID(), attemptDir)
+		d.journal.record(j, stateSucceeded, h, attempts)
+		return &result{job: j, ok: true}
+	}
+	switch {
+	case len(tried) > 0:
+		logError("FAILED id=%v exhausted all servers and could not complete", j.logID())
+	case d.pool.satisfiable(j):
+		logError("FAILED id=%v every host it could run on was dropped from the run", j.logID())
+	default:
+		logError("FAILED id=%v no host satisfies requires=%v", j.logID(), strings.Join(j.requires, ","))
+	}
+	return &result{job: j}
+}
+
+// retrying reports whether j, having failed failures times, still has a
+// retry left and a host to retry on.
+func (d *dispatcher) retrying(j *job, tried map[*host]bool, retryOn *host, failures int) bool {
+	if retries := d.retriesOf(j); retries >= 0 && failures > retries {
+		return false
+	}
+	return retryOn != nil || d.pool.untried(j, tried)
+}
+
+// retriesOf returns how many failed runs of j to retry.
+func (d *dispatcher) retriesOf(j *job) int {
+	if j.retries != nil {
+		return *j.retries
+	}
+	return d.retries
+}
+
+// inDir returns command prefixed to run in dir on h, creating it first if
+// it is missing.
+func inDir(h *host, dir, command string) string {
+	if h.winrm != "" {
+		quoted := `"` + dir + `"`
+		return "(if not exist " + quoted + " mkdir " + quoted + ") && cd /d " + quoted + " && " + command
+	}
+	return "mkdir -p " + shellQuote(dir) + " && cd " + shellQuote(dir) + " && " + command
+}
+
+// safeCommand returns command wrapped to reach h byte for byte and run with
+// sh, whatever quotes, $ or globs it has and whatever the login shell is: it
+// goes base64-encoded, which only has characters no shell does anything
+// with, and is decoded on the host. Commands for WinRM hosts are left as
+// they are.
+func safeCommand(h *host, command string) string {
+	if h.winrm != "" {
+		return command
+	}
+	encoded := base64.StdEncoding.EncodeToString([]byte(command))
+	return `sh -c "$(printf %s ` + encoded + ` | base64 -d)"`
+}
+
+// run makes one attempt of j on the host it has claimed, stopping it early if
+// the claim gets preempted, the attempt runs past its timeout or its output
+// stalls.
+func (d *dispatcher) run(j *job, c *claim, attempt int, stdout, stderr io.Writer) error {
+	timeout := d.timeout
+	if j.timeout > 0 {
+		timeout = j.timeout
+	}
+	outdir := d.output.attemptDir(j.id, attempt)
+	if abs, err := filepath.Abs(outdir); err == nil {
+		outdir = abs
+	}
+	command := expandCommand(j.command, map[string]string{
+		"host":    c.host.name,
+		"id":      strconv.Itoa(j.id),
+		"attempt": strconv.Itoa(attempt),
+		"outdir":  outdir,
+	})
+	if j.script != nil {
+		command = scriptCommand(j, command)
+	}
+	if d.safeQuoting {
+		command = safeCommand(c.host, command)
+	}
+	command = withEnv(c.host, j.env, command)
+	if dir := j.chdir; dir != "" || d.chdir != "" {
+		if dir == "" {
+			dir = d.chdir
+		}
+		command = inDir(c.host, dir, command)
+	}
+	pty := d.pty
+	if j.pty != nil {
+		pty = *j.pty
+	}
+	if !d.stoppable && timeout <= 0 && d.stall <= 0 {
+		return runCommand(context.Background(), command, c.host, pty, stdout, stderr)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rp := newRemoteProcess(c.host, j.id, attempt, cancel)
+	defer rp.finished()
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	var check <-chan time.Time
+	activity, errActivity := newActivityWriter(stdout), newActivityWriter(stderr)
+	if d.stall > 0 {
+		ticker := time.NewTicker(d.stall / 4)
+		defer ticker.Stop()
+		check = ticker.C
+	}
+	// Set to why the attempt was stopped, if it was stopped by us
+	stopped := make(chan error, 1)
+	go func() {
+		for {
+			select {
+			case <-c.preempt:
+				rp.stop()
+				return
+			case <-expired:
+				logDetail("TIMEOUT id=%v host=%v after %v, stopping it", j.logID(), c.host.name, timeout)
+				stopped <- fmt.Errorf("%w after %v", errTimedOut, timeout)
+				rp.stop()
+				return
+			case <-check:
+				if idle := min(activity.idle(), errActivity.idle()); idle > d.stall {
+					logDetail("STALL id=%v host=%v no output for %v, stopping it", j.logID(), c.host.name, idle.Round(time.Second))
+					stopped <- fmt.Errorf("%w with no output for %v", errStalled, d.stall)
+					rp.stop()
+					return
+				}
+			case <-rp.done:
+				return
+			}
+		}
+	}()
+	err := runCommand(ctx, rp.wrap(command), c.host, pty, activity, errActivity)
+	select {
+	case why := <-stopped:
+		return why
+	default:
+		return err
+	}
+}
+
+// attemptBudget caps the number of attempts made across all commands, so a
+// broken cluster doesn't make every command try every host. A nil budget is
+// unlimited.
+type attemptBudget struct {
+	mu   sync.Mutex
+	left int
+}
+
+func newAttemptBudget(max int) *attemptBudget {
+	if max <= 0 {
+		return nil
+	}
+	return &attemptBudget{left: max}
+}
+
+// take spends one attempt, returning false if there are none left.
+func (b *attemptBudget) take() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.left == 0 {
+		return false
+	}
+	b.left--
+	return true
+}
+
+// refund gives back an attempt that was taken but never made.
+func (b *attemptBudget) refund() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.left++
+	b.mu.Unlock()
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Host name prefix of hosts that run every command in a fresh container of
+// an image, e.g. docker://alpine:3.20
+const dockerScheme = "docker://"
+
+// docker exits with this status when it couldn't run the container at all
+const dockerFailed = 125
+
+// Numbers the containers disgo starts, to name them
+var containers atomic.Int64
+
+// dockerExecutor runs commands through sh in a fresh container of the image of
+// the host, removed once it exits. Cancelling ctx stops the container, with
+// killGrace for the command to exit after SIGTERM.
+type dockerExecutor struct{}
+
+func (dockerExecutor) run(ctx context.Context, h *host, command string, opts runOptions, stdout, stderr io.Writer) (exitStatus, error) {
+	name := fmt.Sprintf("disgo-%v-%v", os.Getpid(), containers.Add(1))
+	args := []string{"run", "--rm", "--name", name}
+	if opts.stdin != nil {
+		args = append(args, "--interactive")
+	}
+	if opts.pty {
+		args = append(args, "--tty")
+	}
+	for _, key := range envNames(commandEnv) {
+		// Taken from our environment, which keeps values off the command line
+		args = append(args, "--env", key)
+	}
+	args = append(args, h.image, "sh", "-c", command)
+	cmd := exec.CommandContext(ctx, "docker", dockerArgs(h, args...)...)
+	logTrace("DOCKER host=%v args=%q", h.name, cmd.Args[1:])
+	if len(commandEnv) > 0 {
+		cmd.Env = append(os.Environ(), commandEnv...)
+	}
+	cmd.Stdin = opts.stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.Cancel = func() error {
+		// Killing the docker client would leave the container running
+		stop := exec.Command("docker", dockerArgs(h, "stop", "-t", strconv.Itoa(int(killGrace/time.Second)), name)...)
+		return stop.Run()
+	}
+	cmd.WaitDelay = killGrace + 5*time.Second
+	err := cmd.Run()
+	status, runErr := processStatus(err)
+	if status == dockerFailed {
+		return 0, fmt.Errorf("docker could not run %v: %w", h.image, err)
+	}
+	return status, runErr
+}
+
+// dockerArgs returns args for the docker command line, pointed at the Docker
+// daemon of h.
+func dockerArgs(h *host, args ...string) []string {
+	if h.dockerHost != "" {
+		args = append([]string{"-H", h.dockerHost}, args...)
+	}
+	return args
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// commandEnv holds KEY=VALUE pairs to set in the environment of every
+// command. Each executor passes them the way its transport provides for,
+// so sshd only lets through the ones its AcceptEnv allows.
+var commandEnv []string
+
+// checkEnv checks that kv looks like KEY=VALUE with a valid variable name.
+func checkEnv(kv string) error {
+	key, _, ok := strings.Cut(kv, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("environment variable must look like KEY=VALUE, got %q", kv)
+	}
+	for i, r := range key {
+		if r != '_' && !('a' <= r && r <= 'z') && !('A' <= r && r <= 'Z') && !(i > 0 && '0' <= r && r <= '9') {
+			return fmt.Errorf("bad environment variable name %q", key)
+		}
+	}
+	return nil
+}
+
+// parseEnvFile reads KEY=VALUE lines from an env file, skipping blank lines
+// and # comments.
+func parseEnvFile(path string) ([]string, error) {
+	lines, err := readLines(path)
+	if err != nil {
+		return nil, err
+	}
+	var env []string
+	for n, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		if err := checkEnv(line); err != nil {
+			return nil, fmt.Errorf("%v line %v: %v", path, n+1, err)
+		}
+		env = append(env, line)
+	}
+	return env, nil
+}
+
+// envNames returns the names of the variables in env.
+func envNames(env []string) []string {
+	names := make([]string, len(env))
+	for i, kv := range env {
+		names[i], _, _ = strings.Cut(kv, "=")
+	}
+	return names
+}
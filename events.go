@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// Kinds of events in the event log
+const (
+	eventStarted   = "started"   // an attempt started on a host
+	eventFailed    = "failed"    // an attempt failed
+	eventPreempted = "preempted" // an attempt was stopped to make room for another command
+	eventSucceeded = "succeeded" // an attempt succeeded, and with it the command
+	eventGaveUp    = "gave-up"   // the command failed for good
+)
+
+// An event is one line of the event log.
+type event struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	ID       int       `json:"id"`
+	Label    string    `json:"label,omitempty"`
+	Attempt  int       `json:"attempt"`
+	Host     string    `json:"host,omitempty"`
+	Exit     *int      `json:"exit_code,omitempty"`
+	Duration float64   `json:"duration_seconds,omitempty"` // of the attempt, once it is over
+	Error    string    `json:"error,omitempty"`
+	Cause    string    `json:"cause,omitempty"`
+}
+
+// An eventLog writes what happens during a run to a file as JSON Lines, for
+// tools to read instead of the log. A nil eventLog writes nothing.
+type eventLog struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// openEventLog opens the event log at path, appending to it if it exists.
+func openEventLog(path string) (*eventLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &eventLog{enc: json.NewEncoder(f)}, nil
+}
+
+// emit appends e to the log, timestamped now unless it has a time already.
+func (l *eventLog) emit(e event) {
+	if l == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.enc.Encode(e); err != nil {
+		logError("ERROR could not write to the event log: %v", err)
+	}
+}
+
+// ended appends an event of the given kind for the attempt m describes.
+func (l *eventLog) ended(kind string, m *attemptMeta) {
+	l.emit(event{
+		Time:     m.Finished,
+		Event:    kind,
+		ID:       m.ID,
+		Label:    m.Label,
+		Attempt:  m.Attempt,
+		Host:     m.Host,
+		Exit:     m.Exit,
+		Duration: m.Duration,
+		Error:    m.Error,
+		Cause:    m.Cause,
+	})
+}
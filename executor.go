@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+)
+
+// An exitStatus is the status a command exited with, -1 if it was killed by
+// a signal.
+type exitStatus int
+
+// An executor runs commands on one kind of host. run returns an error only
+// if the command couldn't be run to the end, e.g. the host was unreachable;
+// a command that ran and failed is a non-zero status. Cancelling ctx must
+// stop the command, or at least stop waiting for it.
+type executor interface {
+	run(ctx context.Context, h *host, command string, opts runOptions, stdout, stderr io.Writer) (exitStatus, error)
+}
+
+// runOptions are the settings of a single command run by an executor.
+type runOptions struct {
+	stdin io.Reader // nil if the command gets no input
+	pty   bool      // run the command on a pseudo-terminal, where it writes stdout and stderr alike
+}
+
+// executorFor returns the executor that runs commands on h.
+func executorFor(h *host) executor {
+	switch {
+	case h.winrm != "":
+		return winrmExecutor{}
+	case h.name == localHost:
+		return localExecutor{}
+	case h.image != "":
+		return dockerExecutor{}
+	case h.pod != "":
+		return kubectlExecutor{}
+	case nativeSSH != nil:
+		return nativeExecutor{nativeSSH}
+	}
+	return sshExecutor{}
+}
+
+// A commandExitError is a command that ran and exited with an error. Unlike
+// ssh's status 255, its status is always the command's own.
+type commandExitError struct {
+	status exitStatus
+}
+
+func (e *commandExitError) Error() string {
+	if e.status < 0 {
+		return "killed by a signal"
+	}
+	return fmt.Sprintf("exit status %v", e.status)
+}
+
+// tryCommand runs remoteCommand on h, with its output going to outf. A
+// command that ran and failed returns a *commandExitError, any other error
+// means it didn't run to the end.
+func tryCommand(ctx context.Context, remoteCommand string, h *host, outf io.Writer) error {
+	return runCommand(ctx, remoteCommand, h, false, outf, outf)
+}
+
+// runCommand is tryCommand with stdout and stderr kept apart, on a
+// pseudo-terminal if pty is set. A pseudo-terminal has only the one output,
+// which goes to stdout.
+func runCommand(ctx context.Context, remoteCommand string, h *host, pty bool, stdout, stderr io.Writer) error {
+	opts := runOptions{pty: pty}
+	if becomeUser != "" && h.winrm == "" {
+		remoteCommand, opts.stdin = become(remoteCommand)
+	}
+	status, err := executorFor(h).run(ctx, h, remoteCommand, opts, stdout, stderr)
+	if err == nil && status != 0 {
+		err = &commandExitError{status: status}
+	}
+	return err
+}
+
+// processStatus splits the error of a finished local process into its exit
+// status and an error for not having started or exited at all.
+func processStatus(err error) (exitStatus, error) {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitStatus(exitErr.ExitCode()), nil
+	}
+	return 0, err
+}
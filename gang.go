@@ -0,0 +1,88 @@
+package main
+
+import "strings"
+
+// A gang is a set of commands that must start together, each on a different
+// host, e.g. the ranks of an MPI job. Members wait in the pool until all of
+// them have arrived and there is a free slot for each on distinct hosts.
+type gang struct {
+	name     string
+	size     int
+	arrived  []*job
+	tried    map[*job]map[*host]bool
+	claims   map[*job]*claim // slots claimed for members that have yet to pick them up
+	launched bool            // once started, retries of members are placed like any job
+}
+
+// acquireGang waits until every member of the gang of j has arrived and the
+// gang can be placed, then returns the claim made for j. It must be called
+// with the pool locked.
+func (p *hostPool) acquireGang(j *job, tried map[*host]bool) *claim {
+	g := p.gangs[j.gang]
+	if g == nil {
+		g = &gang{
+			name:   j.gang,
+			size:   p.gangSizes[j.gang],
+			tried:  make(map[*job]map[*host]bool),
+			claims: make(map[*job]*claim),
+		}
+		p.gangs[j.gang] = g
+	}
+	g.arrived = append(g.arrived, j)
+	g.tried[j] = tried
+	for {
+		if c, ok := g.claims[j]; ok {
+			delete(g.claims, j)
+			return c
+		}
+		if p.closed {
+			return nil
+		}
+		if !g.launched && len(g.arrived) == g.size {
+			if placement := p.placeGang(g); placement != nil {
+				var names []string
+				for _, member := range g.arrived {
+					h := placement[member]
+					g.claims[member] = p.claim(member, h, g.tried[member], false)
+					names = append(names, h.name)
+				}
+				g.launched = true
+				logInfo("GANG name=%v size=%v hosts=%v", g.name, g.size, strings.Join(names, ","))
+				p.freed.Broadcast()
+				continue
+			}
+		}
+		p.freed.Wait()
+	}
+}
+
+// placeGang finds a distinct host with a free slot for every member of g,
+// or returns nil if there is no such placement right now. It is a bipartite
+// matching of members to hosts using augmenting paths.
+func (p *hostPool) placeGang(g *gang) map[*job]*host {
+	owner := make(map[*host]*job)
+	var augment func(member *job, seen map[*host]bool) bool
+	augment = func(member *job, seen map[*host]bool) bool {
+		for _, h := range p.candidates(member, g.tried[member]) {
+			if seen[h] || !p.hasRoom(member, h) {
+				continue
+			}
+			seen[h] = true
+			if other, taken := owner[h]; !taken || augment(other, seen) {
+				owner[h] = member
+				return true
+			}
+		}
+		return false
+	}
+	for _, member := range g.arrived {
+		if !augment(member, make(map[*host]bool)) {
+			return nil
+		}
+	}
+	placement := make(map[*job]*host)
+	for h, member := range owner {
+		placement[member] = h
+	}
+	return placement
+}
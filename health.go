@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// healthyHosts runs command on every host in parallel and returns the hosts
+// where it succeeded within timeout, in their original order. The others are
+// logged and left out.
+func healthyHosts(hosts []*host, command string, timeout time.Duration) []*host {
+	ok := make([]bool, len(hosts))
+	var wg sync.WaitGroup
+	for i, h := range hosts {
+		wg.Add(1)
+		go func(i int, h *host) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			if err := tryCommand(ctx, command, h, io.Discard); err != nil {
+				logInfo("UNHEALTHY host=%v dropped: %v", h.name, err)
+				return
+			}
+			ok[i] = true
+		}(i, h)
+	}
+	wg.Wait()
+	var healthy []*host
+	for i, h := range hosts {
+		if ok[i] {
+			healthy = append(healthy, h)
+		}
+	}
+	logInfo("HEALTH %v of %v hosts healthy", len(healthy), len(hosts))
+	return healthy
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// runFailureHook runs the -on-failure command for r, a command that failed
+// for good. The placeholders {id}, {host}, {exit} and {command} are replaced
+// with shell-quoted values; {host} is empty if the command never ran and
+// {exit} is -1 if it didn't exit on its own.
+func (d *dispatcher) runFailureHook(r *result) {
+	hostName := ""
+	if r.host != nil {
+		hostName = r.host.name
+	}
+	hook := strings.NewReplacer(
+		"{id}", fmt.Sprint(r.job.id),
+		"{host}", shellQuote(hostName),
+		"{exit}", fmt.Sprint(exitCode(r.err)),
+		"{command}", shellQuote(r.job.command),
+	).Replace(d.onFailure)
+	cmd := exec.Command("sh", "-c", hook)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		logError("ERROR on-failure hook for id=%v: %v", r.job.id, err)
+	}
+}
+
+// shellQuote quotes s so that sh reads it back as a single word.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
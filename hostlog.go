@@ -0,0 +1,125 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hostLogs writes a log per host to <dir>/<host>.log holding every attempt
+// run on the host, one after the other as they end, for when the question is
+// what is wrong with a host rather than with a command. A nil hostLogs writes
+// nothing.
+type hostLogs struct {
+	dir   string
+	mu    sync.Mutex
+	files map[string]*os.File
+}
+
+func newHostLogs(dir string) (*hostLogs, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &hostLogs{dir: dir, files: make(map[string]*os.File)}, nil
+}
+
+// add appends an attempt to the log of its host: a header saying what ran,
+// the output of the attempt from its closed files in dir, and how it ended.
+func (l *hostLogs) add(m *attemptMeta, dir string, out *attemptOutput) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f := l.files[m.Host]
+	if f == nil {
+		var err error
+		f, err = os.OpenFile(filepath.Join(l.dir, pathSafe(m.Host)+".log"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		l.files[m.Host] = f
+	}
+	fmt.Fprintf(f, "=== id=%v attempt=%v started=%v command=%q\n", m.ID, m.Attempt, m.Started.Format(time.RFC3339), m.Command)
+	for _, o := range out.files() {
+		if len(out.files()) > 1 {
+			fmt.Fprintf(f, "--- %v\n", strings.TrimSuffix(o.name, ".gz"))
+		}
+		if err := copyOutput(f, filepath.Join(dir, o.name)); err != nil {
+			fmt.Fprintf(f, "[disgo: could not read %v: %v]\n", o.name, err)
+		}
+	}
+	status := "ok"
+	switch {
+	case m.Error != "":
+		status = "error=" + m.Error
+	case !m.OK:
+		status = "preempted"
+	}
+	exit := "none"
+	if m.Exit != nil {
+		exit = fmt.Sprint(*m.Exit)
+	}
+	_, err := fmt.Fprintf(f, "=== id=%v attempt=%v duration=%.3fs exit=%v %v\n\n", m.ID, m.Attempt, m.Duration, exit, status)
+	return err
+}
+
+// copyOutput copies the output file at path to w, uncompressed, making sure
+// it ends in a newline.
+func copyOutput(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		r = zr
+	}
+	last := &lastByte{w: w}
+	if _, err := io.Copy(last, r); err != nil {
+		return err
+	}
+	if last.b != 0 && last.b != '\n' {
+		_, err = w.Write([]byte("\n"))
+	}
+	return err
+}
+
+// lastByte passes writes on to w, remembering the last byte written.
+type lastByte struct {
+	w io.Writer
+	b byte
+}
+
+func (l *lastByte) Write(p []byte) (int, error) {
+	n, err := l.w.Write(p)
+	if n > 0 {
+		l.b = p[n-1]
+	}
+	return n, err
+}
+
+// close closes the logs, returning their paths.
+func (l *hostLogs) close() []string {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var paths []string
+	for _, f := range l.files {
+		paths = append(paths, f.Name())
+		f.Close()
+	}
+	return paths
+}
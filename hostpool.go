@@ -0,0 +1,675 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Host selection policies understood by the host pool
+const (
+	scheduleRandom      = "random"
+	scheduleLeastLoaded = "leastloaded"
+	scheduleRoundRobin  = "roundrobin"
+)
+
+// hostPool hands hosts out to dispatched commands. It tracks how many
+// commands are in flight on each host so that a busy host makes new commands
+// queue up instead of piling more ssh sessions onto it, and so that hosts can
+// be picked by load. Every policy honours host weights, so a host with
+// weight=4 gets roughly four times the work of a host with weight=1. Commands
+// in the same group stick to the host the group was first placed on whenever
+// it has room. Hosts that keep failing or run slow can be made to get less
+// work by scaling their weights with their scores.
+//
+// Commands waiting for a busy host line up in that host's pending queue and
+// are handed its slots by priority, in FIFO order within a priority. With
+// stealing enabled, a host that has a free slot and nothing queued of its own
+// takes the last command from the longest queue instead of sitting idle.
+//
+// With backfill enabled, every command that has been running on a host for
+// longer than the backfill window lends the host one extra slot that only
+// short commands, whose #duration hint fits in the window, may use. Long jobs
+// often leave a host partly idle, and short ones can squeeze in alongside.
+type hostPool struct {
+	hostPoolOptions
+	mu      sync.Mutex
+	freed   *sync.Cond
+	hosts   []*host
+	active  map[*host]int
+	pending map[*host][]*job
+	current map[*host]int // smooth weighted round robin state
+	groups  map[string]*host
+	load    *loadProber // if set, overloaded hosts are avoided
+	breaker *breaker    // if set, hosts that keep failing to connect get a rest
+	dead    *quarantine // if set, hosts that look dead are held out until they answer
+	rand    *rand.Rand
+	adapt   *aimd // set when slots are adaptive
+	queued  map[queueSlot]int
+	running map[*job]*claim
+	gangs   map[string]*gang
+	// backfilled counts the backfill slots in use on each host; those
+	// commands are not counted in active
+	backfilled map[*host]int
+	closed     bool // set by shutdown
+	scores     *hostScores
+	dropped    map[*host]bool // hosts out of the run for failing too often
+}
+
+// A claim is a job's hold on a slot of a host while it runs there.
+type claim struct {
+	host       *host
+	started    time.Time
+	backfill   bool
+	preempt    chan struct{} // closed when the job should make way
+	preempting bool
+}
+
+// isPreempted reports whether the job was asked to make way for another.
+func (c *claim) isPreempted() bool {
+	select {
+	case <-c.preempt:
+		return true
+	default:
+		return false
+	}
+}
+
+// A queueSlot counts the commands of a named queue running on a host, or in
+// total when host is nil.
+type queueSlot struct {
+	host  *host
+	queue string
+}
+
+// hostPoolOptions tune how a hostPool places commands.
+type hostPoolOptions struct {
+	mode       string // host selection policy
+	maxPerHost int    // slots on hosts that don't advertise their own, 0 for unlimited
+	steal      bool   // let idle hosts steal commands queued for busy ones
+	seed       int64  // seed for random choices, so placements can be replayed
+	adaptive   bool   // grow and shrink each host's slots with AIMD
+	adaptMax   int    // ceiling for adaptive slots on hosts without a limit
+	queues     map[string]queueLimit
+	backfill   time.Duration // longest #duration hint that may backfill, 0 to disable
+	preempt    bool          // stop lower priority commands to make room for higher ones
+	gangSizes  map[string]int
+	avoidFlaky bool // scale host weights by their scores
+	// maxFailures drops a host from the run once it has failed this many
+	// attempts, 0 to never drop hosts
+	maxFailures int
+}
+
+// newHostPool creates a pool over hosts.
+func newHostPool(hosts []*host, opts hostPoolOptions) (*hostPool, error) {
+	switch opts.mode {
+	case scheduleRandom, scheduleLeastLoaded, scheduleRoundRobin:
+	default:
+		return nil, fmt.Errorf("unknown schedule %q", opts.mode)
+	}
+	p := &hostPool{
+		hostPoolOptions: opts,
+		hosts:           hosts,
+		active:          make(map[*host]int),
+		pending:         make(map[*host][]*job),
+		current:         make(map[*host]int),
+		groups:          make(map[string]*host),
+		queued:          make(map[queueSlot]int),
+		running:         make(map[*job]*claim),
+		gangs:           make(map[string]*gang),
+		backfilled:      make(map[*host]int),
+		rand:            rand.New(rand.NewSource(opts.seed)),
+		scores:          newHostScores(),
+		dropped:         make(map[*host]bool),
+	}
+	if opts.adaptive {
+		p.adapt = newAIMD()
+	}
+	p.freed = sync.NewCond(&p.mu)
+	return p, nil
+}
+
+// acquire picks the next host for j, which has already been attempted on the
+// hosts in tried, claims a slot on it and marks it as tried. Only hosts whose
+// labels satisfy the requirements of j are considered. It blocks until the
+// picked host has a free slot, and returns nil once every eligible host has
+// been tried or the pool has been shut down. With preemption enabled, a job
+// kept waiting by lower priority ones asks one of them to make way.
+func (p *hostPool) acquire(j *job, tried map[*host]bool) *claim {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if g := p.gangs[j.gang]; j.gang != "" && (g == nil || !g.launched) {
+		return p.acquireGang(j, tried)
+	}
+	var h, queued *host
+	backfill, preempted := false, false
+	for {
+		h = p.pick(j, tried, h)
+		if p.closed {
+			// Nothing new starts once the pool is shut down
+			h = nil
+		}
+		if queued != nil && queued != h {
+			p.dequeue(queued, j)
+			queued = nil
+		}
+		if h == nil {
+			return nil
+		}
+		if p.hasRoom(j, h) && p.nextInLine(h, j) {
+			break
+		}
+		if p.canBackfill(j, h) {
+			logDetail("BACKFILL id=%v host=%v", j.id, h.name)
+			backfill = true
+			break
+		}
+		if thief := p.thief(j, h, tried, queued != nil); thief != nil {
+			logDetail("STEAL id=%v from=%v to=%v", j.id, h.name, thief.name)
+			h = thief
+			break
+		}
+		if queued == nil {
+			p.enqueue(h, j)
+			queued = h
+		}
+		if p.preempt && !preempted && p.allowed(j, h) {
+			preempted = p.preemptFor(j, h)
+		}
+		p.freed.Wait()
+	}
+	if queued != nil {
+		p.dequeue(queued, j)
+		// Whoever is next in line may be able to use another free slot
+		p.freed.Broadcast()
+	}
+	return p.claim(j, h, tried, backfill)
+}
+
+// claim takes a slot on h for j, or a backfill slot, and marks h as tried.
+func (p *hostPool) claim(j *job, h *host, tried map[*host]bool, backfill bool) *claim {
+	if j.group != "" && p.groups[j.group] == nil {
+		p.groups[j.group] = h
+	}
+	tried[h] = true
+	if p.breaker != nil {
+		p.breaker.claimed(h)
+	}
+	if backfill {
+		p.backfilled[h]++
+	} else {
+		p.active[h]++
+		if p.backfill > 0 {
+			// Look again once this command counts as long running
+			time.AfterFunc(p.backfill, p.wake)
+		}
+	}
+	c := &claim{host: h, started: time.Now(), backfill: backfill, preempt: make(chan struct{})}
+	p.running[j] = c
+	if j.queue != "" {
+		p.queued[queueSlot{nil, j.queue}]++
+		p.queued[queueSlot{h, j.queue}]++
+	}
+	return c
+}
+
+// preemptFor asks a command running on h with a lower priority than j to
+// make way for it, returning false if there is none. The lowest priority goes
+// first, and among equals the newest, since it has the least work to lose.
+func (p *hostPool) preemptFor(j *job, h *host) bool {
+	var victim *job
+	for other, c := range p.running {
+		if c.host != h || c.backfill || c.preempting || other.priority >= j.priority {
+			continue
+		}
+		if victim == nil || other.priority < victim.priority ||
+			(other.priority == victim.priority && c.started.After(p.running[victim].started)) {
+			victim = other
+		}
+	}
+	if victim == nil {
+		return false
+	}
+	c := p.running[victim]
+	c.preempting = true
+	close(c.preempt)
+	logDetail("PREEMPT id=%v host=%v for id=%v", victim.id, h.name, j.id)
+	return true
+}
+
+// pick chooses a host for j given the host prev picked for it the last time
+// around, if acquire had to wait. A command waiting on a host that stopped
+// being available, e.g. for being quarantined, is moved to another.
+func (p *hostPool) pick(j *job, tried map[*host]bool, prev *host) *host {
+	if sticky := p.groups[j.group]; sticky != nil && !tried[sticky] && p.eligible(j, sticky) && p.hasRoom(j, sticky) {
+		return sticky
+	}
+	switch p.mode {
+	case scheduleLeastLoaded:
+		// Loads change while we wait, so pick again every time around
+		return p.leastLoaded(j, tried)
+	case scheduleRoundRobin:
+		if prev == nil || !p.available(prev) {
+			prev = p.roundRobin(j, tried)
+		}
+	default:
+		if prev == nil || !p.available(prev) {
+			prev = p.randomHost(j, tried)
+		}
+	}
+	return prev
+}
+
+// hasRoom reports whether h can take j right now.
+func (p *hostPool) hasRoom(j *job, h *host) bool {
+	if !p.allowed(j, h) {
+		return false
+	}
+	limit := p.limit(h)
+	return limit <= 0 || p.active[h] < limit
+}
+
+// canBackfill reports whether j is short enough to take a backfill slot on h,
+// and h has one to spare.
+func (p *hostPool) canBackfill(j *job, h *host) bool {
+	if p.backfill <= 0 || j.duration <= 0 || j.duration > p.backfill || !p.allowed(j, h) {
+		return false
+	}
+	long := 0
+	for _, c := range p.running {
+		if c.host == h && !c.backfill && time.Since(c.started) > p.backfill {
+			long++
+		}
+	}
+	return long > p.backfilled[h]
+}
+
+// allowed reports whether anything other than free slots keeps j off h right
+// now: the state of the host or the limits of the job's named queue.
+func (p *hostPool) allowed(j *job, h *host) bool {
+	if !p.available(h) {
+		return false
+	}
+	if limit, ok := p.queues[j.queue]; ok {
+		if limit.total > 0 && p.queued[queueSlot{nil, j.queue}] >= limit.total {
+			return false
+		}
+		if limit.perHost > 0 && p.queued[queueSlot{h, j.queue}] >= limit.perHost {
+			return false
+		}
+	}
+	return true
+}
+
+// available reports whether h is fit to take commands at the moment: it is
+// not overloaded, its circuit is not open and it is neither quarantined nor
+// dropped.
+func (p *hostPool) available(h *host) bool {
+	if p.dropped[h] {
+		return false
+	}
+	if p.load != nil && p.load.overloaded(h) {
+		return false
+	}
+	if p.breaker != nil && p.breaker.blocked(h) {
+		return false
+	}
+	return p.dead == nil || !p.dead.quarantined(h)
+}
+
+// limit returns how many commands h may run at once, 0 for unlimited.
+func (p *hostPool) limit(h *host) int {
+	limit := p.staticLimit(h)
+	if p.adapt != nil {
+		max := limit
+		if max <= 0 {
+			max = p.adaptMax
+		}
+		return p.adapt.limit(h, max)
+	}
+	return limit
+}
+
+// staticLimit returns the configured slots of h, 0 for unlimited.
+func (p *hostPool) staticLimit(h *host) int {
+	if h.slots > 0 {
+		return h.slots
+	}
+	return p.maxPerHost
+}
+
+// capacity returns how many commands the pool can run at once, or 0 if some
+// host has no limit.
+func (p *hostPool) capacity() int {
+	total := 0
+	for _, h := range p.hosts {
+		limit := p.staticLimit(h)
+		if limit <= 0 {
+			return 0
+		}
+		total += limit
+	}
+	return total
+}
+
+// shutdown stops the pool from handing out any more slots. Commands waiting
+// for a host give up, and commands already running are left alone.
+func (p *hostPool) shutdown() {
+	p.mu.Lock()
+	p.closed = true
+	p.freed.Broadcast()
+	p.mu.Unlock()
+}
+
+// isShutdown reports whether shutdown has been called.
+func (p *hostPool) isShutdown() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed
+}
+
+// wake makes every command waiting for a host look again, for when something
+// other than a released slot may have made a host available.
+func (p *hostPool) wake() {
+	p.mu.Lock()
+	p.freed.Broadcast()
+	p.mu.Unlock()
+}
+
+// nextInLine reports whether j may take the next free slot on h, meaning no
+// command queued ahead of it could use the slot instead. Commands held back
+// by their named queue's limits don't block the ones behind them.
+func (p *hostPool) nextInLine(h *host, j *job) bool {
+	for _, ahead := range p.pending[h] {
+		if ahead == j {
+			return true
+		}
+		if p.hasRoom(ahead, h) {
+			return false
+		}
+	}
+	return true
+}
+
+// enqueue adds j to the pending queue of h behind every command of the same
+// or higher priority.
+func (p *hostPool) enqueue(h *host, j *job) {
+	q := p.pending[h]
+	i := len(q)
+	for i > 0 && q[i-1].priority < j.priority {
+		i--
+	}
+	q = append(q, nil)
+	copy(q[i+1:], q[i:])
+	q[i] = j
+	p.pending[h] = q
+}
+
+// dequeue removes j from the pending queue of h.
+func (p *hostPool) dequeue(h *host, j *job) {
+	q := p.pending[h]
+	for i := range q {
+		if q[i] == j {
+			p.pending[h] = append(q[:i], q[i+1:]...)
+			return
+		}
+	}
+}
+
+// thief finds an idle host to steal j from the queue of h, if stealing is
+// enabled. Only the last command of the longest queue gets stolen, so
+// commands keep their place in line on their own host for as long as
+// possible. queued says whether j is already in the queue of h.
+func (p *hostPool) thief(j *job, h *host, tried map[*host]bool, queued bool) *host {
+	if !p.steal {
+		return nil
+	}
+	q := p.pending[h]
+	depth := len(q)
+	if queued {
+		if q[depth-1] != j {
+			return nil
+		}
+	} else {
+		if depth > 0 && q[depth-1].priority < j.priority {
+			// j would be queued ahead of others, leave those to be stolen
+			return nil
+		}
+		depth++
+	}
+	for _, other := range p.pending {
+		if len(other) > depth {
+			return nil
+		}
+	}
+	var best *host
+	for _, t := range p.hosts {
+		if t == h || tried[t] || !p.eligible(j, t) || !p.hasRoom(j, t) || len(p.pending[t]) > 0 {
+			continue
+		}
+		if best == nil || p.active[t]*best.weight < p.active[best]*t.weight {
+			best = t
+		}
+	}
+	return best
+}
+
+// release gives back a slot on h claimed by acquire for j, after j ran there
+// for elapsed, failing for cause unless ok. If j failed on the host its group
+// sticks to, the group is free to settle somewhere else.
+func (p *hostPool) release(j *job, h *host, ok bool, cause string, elapsed time.Duration) {
+	p.mu.Lock()
+	p.scores.record(h, ok, elapsed)
+	if failures := p.scores.failures[h]; p.maxFailures > 0 && failures >= p.maxFailures && !p.dropped[h] {
+		p.dropped[h] = true
+		logInfo("DROP host=%v after %v failures", h.name, failures)
+	}
+	if p.adapt != nil && (ok || hostFault(cause)) {
+		// A command failing by itself says nothing about how busy h is
+		max := p.staticLimit(h)
+		if max <= 0 {
+			max = p.adaptMax
+		}
+		p.adapt.record(h, ok, elapsed, max)
+	}
+	if !ok && j.group != "" && p.groups[j.group] == h {
+		delete(p.groups, j.group)
+	}
+	if c := p.running[j]; c != nil && c.backfill {
+		p.backfilled[h]--
+	} else {
+		p.active[h]--
+	}
+	delete(p.running, j)
+	if j.queue != "" {
+		p.queued[queueSlot{nil, j.queue}]--
+		p.queued[queueSlot{h, j.queue}]--
+	}
+	p.mu.Unlock()
+	p.freed.Broadcast()
+}
+
+// reached records whether an attempt on h got through to the host.
+func (p *hostPool) reached(h *host, ok bool) {
+	if p.dead != nil {
+		p.dead.record(h, ok)
+	}
+	if p.breaker == nil {
+		return
+	}
+	p.mu.Lock()
+	p.breaker.record(h, ok)
+	p.freed.Broadcast()
+	p.mu.Unlock()
+}
+
+// satisfiable reports whether any host in the pool, dropped or not, meets
+// the requirements of j.
+func (p *hostPool) satisfiable(j *job) bool {
+	for _, h := range p.hosts {
+		if p.eligible(j, h) {
+			return true
+		}
+	}
+	return false
+}
+
+// report logs how every host did over the run.
+func (p *hostPool) report() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.scores.report(p.hosts)
+}
+
+// scoresByName returns the score of every host that was given any work, by
+// host name.
+func (p *hostPool) scoresByName() map[string]float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	scores := make(map[string]float64)
+	for _, h := range p.hosts {
+		if p.scores.attempts[h] > 0 {
+			scores[h.name] = p.scores.score(h)
+		}
+	}
+	return scores
+}
+
+// eligible reports whether j may run on h at all.
+func (p *hostPool) eligible(j *job, h *host) bool {
+	return h.labels.satisfies(j.requires)
+}
+
+// allBut returns a tried set with every host except h in it, which pins a job
+// to h.
+func (p *hostPool) allBut(h *host) map[*host]bool {
+	tried := make(map[*host]bool)
+	for _, other := range p.hosts {
+		tried[other] = other != h
+	}
+	return tried
+}
+
+// untried reports whether any host j is eligible for is not in tried.
+func (p *hostPool) untried(j *job, tried map[*host]bool) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.candidates(j, tried)) > 0
+}
+
+// candidates lists the hosts j is eligible for that are not in tried. Hosts
+// that are not available are left out unless there is nothing else, and if j
+// has locality hints only the hosts matching them are listed while there are
+// any.
+func (p *hostPool) candidates(j *job, tried map[*host]bool) []*host {
+	var candidates, calm []*host
+	for _, h := range p.hosts {
+		if !tried[h] && !p.dropped[h] && p.eligible(j, h) {
+			candidates = append(candidates, h)
+			if p.available(h) {
+				calm = append(calm, h)
+			}
+		}
+	}
+	if len(calm) > 0 {
+		candidates = calm
+	}
+	var local []*host
+	for _, h := range candidates {
+		if h.matches(j.prefers) {
+			local = append(local, h)
+		}
+	}
+	if len(local) > 0 {
+		return local
+	}
+	return candidates
+}
+
+// weight returns the weight h is scheduled with. When flaky hosts are being
+// avoided that is its configured weight scaled by its score.
+func (p *hostPool) weight(h *host) int {
+	if !p.avoidFlaky {
+		return h.weight
+	}
+	return int(math.Max(1, math.Round(float64(h.weight)*100*p.scores.score(h))))
+}
+
+// randomHost picks any untried host with probability proportional to its
+// weight.
+func (p *hostPool) randomHost(j *job, tried map[*host]bool) *host {
+	candidates := p.candidates(j, tried)
+	weights := make([]int, len(candidates))
+	total := 0
+	for i, h := range candidates {
+		weights[i] = p.weight(h)
+		total += weights[i]
+	}
+	if total == 0 {
+		return nil
+	}
+	n := p.rand.Intn(total)
+	for i, h := range candidates {
+		if n < weights[i] {
+			return h
+		}
+		n -= weights[i]
+	}
+	return nil
+}
+
+// roundRobin picks untried hosts in a fixed cycle using smooth weighted round
+// robin: every candidate earns its weight, the richest one is picked and pays
+// back the total. With equal weights this visits the hosts in file order.
+func (p *hostPool) roundRobin(j *job, tried map[*host]bool) *host {
+	var best *host
+	total := 0
+	for _, h := range p.candidates(j, tried) {
+		weight := p.weight(h)
+		p.current[h] += weight
+		total += weight
+		if best == nil || p.current[h] > p.current[best] {
+			best = h
+		}
+	}
+	if best != nil {
+		p.current[best] -= total
+	}
+	return best
+}
+
+// leastLoaded picks the untried host with the fewest commands in flight per
+// unit of weight, breaking ties randomly so that an idle cluster still gets
+// spread out. Hosts with a free slot are preferred over full ones.
+func (p *hostPool) leastLoaded(j *job, tried map[*host]bool) *host {
+	candidates := p.candidates(j, tried)
+	var free []*host
+	for _, h := range candidates {
+		if p.hasRoom(j, h) {
+			free = append(free, h)
+		}
+	}
+	if len(free) > 0 {
+		candidates = free
+	}
+	var best []*host
+	for _, h := range candidates {
+		if len(best) > 0 {
+			// Compare active/weight without dividing
+			load, bestLoad := p.active[h]*p.weight(best[0]), p.active[best[0]]*p.weight(h)
+			if load > bestLoad {
+				continue
+			}
+			if load < bestLoad {
+				best = best[:0]
+			}
+		}
+		best = append(best, h)
+	}
+	if len(best) == 0 {
+		return nil
+	}
+	return best[p.rand.Intn(len(best))]
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Every host selection policy, for tests that must hold under all of them
+var scheduleModes = []string{scheduleRandom, scheduleRoundRobin, scheduleLeastLoaded}
+
+// newTestPool creates a pool of two hosts, a and b, with a slot each.
+func newTestPool(t *testing.T, mode string) *hostPool {
+	t.Helper()
+	hosts, err := parseHosts("hosts.txt", []string{"a slots=1", "b slots=1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := newHostPool(hosts, hostPoolOptions{mode: mode, seed: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// testWaiterMoves fills both hosts of p, starts a third job waiting on one of
+// them, makes that host unavailable with disable and frees the other. The
+// waiting job must then move to the host that was freed.
+func testWaiterMoves(t *testing.T, p *hostPool, disable func(h *host)) {
+	t.Helper()
+	first := &job{id: 0, command: "true"}
+	c1 := p.acquire(first, make(map[*host]bool))
+	second := &job{id: 1, command: "true"}
+	c2 := p.acquire(second, map[*host]bool{c1.host: true})
+	if c1 == nil || c2 == nil || c1.host == c2.host {
+		t.Fatalf("the first two jobs didn't get a host each")
+	}
+
+	waiter := &job{id: 2, command: "true"}
+	got := make(chan *claim, 1)
+	go func() {
+		got <- p.acquire(waiter, make(map[*host]bool))
+	}()
+	var waitingOn *host
+	for deadline := time.Now().Add(time.Second); waitingOn == nil; {
+		if time.Now().After(deadline) {
+			t.Fatalf("the third job never queued up on a host")
+		}
+		p.mu.Lock()
+		for h, q := range p.pending {
+			for _, j := range q {
+				if j == waiter {
+					waitingOn = h
+				}
+			}
+		}
+		p.mu.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+
+	freed, freedJob := c1.host, first
+	if freed == waitingOn {
+		freed, freedJob = c2.host, second
+	}
+	disable(waitingOn)
+	p.release(freedJob, freed, true, "", time.Second)
+	select {
+	case c := <-got:
+		if c == nil || c.host != freed {
+			t.Fatalf("the waiting job got %v, want a slot on %v", c, freed.name)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("the job waiting on %v didn't move to %v, which is free", waitingOn.name, freed.name)
+	}
+}
+
+func TestPickLeavesQuarantinedHost(t *testing.T) {
+	for _, mode := range scheduleModes {
+		t.Run(mode, func(t *testing.T) {
+			p := newTestPool(t, mode)
+			p.dead = newQuarantine(1, time.Hour, p.wake)
+			testWaiterMoves(t, p, func(h *host) {
+				p.reached(h, false)
+				if !p.dead.quarantined(h) {
+					t.Fatalf("%v wasn't quarantined", h.name)
+				}
+			})
+		})
+	}
+}
+
+func TestPickLeavesOpenCircuit(t *testing.T) {
+	for _, mode := range scheduleModes {
+		t.Run(mode, func(t *testing.T) {
+			p := newTestPool(t, mode)
+			p.breaker = newBreaker(1, time.Hour, p.wake)
+			testWaiterMoves(t, p, func(h *host) {
+				p.reached(h, false)
+				p.mu.Lock()
+				defer p.mu.Unlock()
+				if !p.breaker.blocked(h) {
+					t.Fatalf("the circuit of %v didn't open", h.name)
+				}
+			})
+		})
+	}
+}
+
+func TestPickLeavesOverloadedHost(t *testing.T) {
+	for _, mode := range scheduleModes {
+		t.Run(mode, func(t *testing.T) {
+			p := newTestPool(t, mode)
+			p.load = newLoadProber(2, time.Hour, p.wake)
+			testWaiterMoves(t, p, func(h *host) {
+				p.load.mu.Lock()
+				p.load.loads[h] = 8
+				p.load.mu.Unlock()
+				p.wake()
+			})
+		})
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// A host is a single entry of the hosts file: a name that ssh can connect to,
+// optionally as user@name:port, followed by optional key=value annotations,
+// e.g. "bigbox01 weight=4 slots=8 labels=gpu,ssd user=batch port=2222" or
+// "batch@[2001:db8::7]:2222 weight=2".
+//
+// A "[name]" line starts a group of hosts, up to the next one. Annotations
+// on that line apply to every host of the group unless the host says
+// otherwise, e.g. "[eu] bastion=eu-bastion user=ops", and every host of the
+// group gets the group's name as a label.
+type host struct {
+	name   string
+	weight int // relative share of the work this host should get
+	slots  int // concurrent commands the host can take, 0 for the global default
+	labels tagSet
+	// How to log in, where empty means whatever ssh would do by default
+	user string
+	port int
+	key  string // private key file
+	jump string // jump hosts to go through, as for ssh -J
+	// Options for the ssh binary, as for ssh -o, that take precedence over
+	// -ssh-opt
+	sshOpts []string
+	// For docker://image hosts, the image every command gets a fresh
+	// container of, and the Docker daemon to run it on if not the local one
+	image      string
+	dockerHost string
+	// For k8s://namespace/pod hosts, the pod commands are run in, through
+	// kubectl exec, and optionally its container and kubectl context
+	namespace   string
+	pod         string
+	container   string
+	kubeContext string
+	// For winrm:// and winrms:// hosts, http or https
+	winrm string
+}
+
+// parseHosts parses the lines of the hosts file at path. Blank lines and #
+// comments, to the end of the line, are skipped, and %include lines parsed in
+// place of the file they name, in the group they are in. A group started in
+// an included file ends with that file.
+func parseHosts(path string, lines []string) ([]*host, error) {
+	var group []string
+	return parseHostLines(path, lines, &group, nil)
+}
+
+// parseHostLines does the work of parseHosts, with group holding the
+// annotations of the current group, its label first, and included the files
+// being included on the way to path.
+func parseHostLines(path string, lines []string, group *[]string, included []string) ([]*host, error) {
+	var hosts []*host
+	for n, line := range lines {
+		fields := strings.Fields(line)
+		for i, f := range fields {
+			if strings.HasPrefix(f, "#") {
+				// A comment to the end of the line
+				fields = fields[:i]
+				break
+			}
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "%include" {
+			inc, ok := includeDirective(path, line)
+			if !ok {
+				return nil, fmt.Errorf("%v line %v: %%include needs a single file", path, n+1)
+			}
+			incLines, stack, err := readInclude(inc, path, included)
+			if err != nil {
+				return nil, fmt.Errorf("%v line %v: %v", path, n+1, err)
+			}
+			outer := *group
+			incHosts, err := parseHostLines(inc, incLines, group, stack)
+			*group = outer
+			if err != nil {
+				return nil, err
+			}
+			hosts = append(hosts, incHosts...)
+			continue
+		}
+		if name, ok := groupName(fields[0]); ok {
+			*group = append([]string{"labels=" + name}, fields[1:]...)
+			// Catch mistakes on the group line even if no host follows
+			if err := (&host{labels: make(tagSet)}).annotateAll(*group); err != nil {
+				return nil, fmt.Errorf("%v line %v: %v", path, n+1, err)
+			}
+			continue
+		}
+		h := &host{weight: 1, labels: make(tagSet)}
+		h.annotateAll(*group)
+		if image, ok := strings.CutPrefix(fields[0], dockerScheme); ok {
+			if image == "" {
+				return nil, fmt.Errorf("%v line %v: %v needs an image", path, n+1, dockerScheme)
+			}
+			h.name, h.image = fields[0], image
+		} else if addr, ok := strings.CutPrefix(fields[0], winrmScheme); ok {
+			if err := h.parseWinRM(addr, false); err != nil {
+				return nil, fmt.Errorf("%v line %v: %v", path, n+1, err)
+			}
+		} else if addr, ok := strings.CutPrefix(fields[0], winrmsScheme); ok {
+			if err := h.parseWinRM(addr, true); err != nil {
+				return nil, fmt.Errorf("%v line %v: %v", path, n+1, err)
+			}
+		} else if pod, ok := strings.CutPrefix(fields[0], k8sScheme); ok {
+			namespace, name, found := strings.Cut(pod, "/")
+			if !found || namespace == "" || name == "" || strings.Contains(name, "/") {
+				return nil, fmt.Errorf("%v line %v: %v must look like %vnamespace/pod", path, n+1, fields[0], k8sScheme)
+			}
+			h.name, h.namespace, h.pod = fields[0], namespace, name
+		} else if err := h.parseAddress(fields[0]); err != nil {
+			return nil, fmt.Errorf("%v line %v: %v", path, n+1, err)
+		}
+		if err := h.annotateAll(fields[1:]); err != nil {
+			return nil, fmt.Errorf("%v line %v: %v", path, n+1, err)
+		}
+		hosts = append(hosts, h)
+	}
+	return hosts, nil
+}
+
+// groupName returns the name of the group a "[name]" field starts. Unlike
+// IPv6 addresses in brackets, group names have no colons.
+func groupName(field string) (string, bool) {
+	if !strings.HasPrefix(field, "[") || !strings.HasSuffix(field, "]") || strings.Contains(field, ":") {
+		return "", false
+	}
+	name := field[1 : len(field)-1]
+	return name, name != ""
+}
+
+// annotateAll applies key=value annotations to the host in order.
+func (h *host) annotateAll(fields []string) error {
+	for _, field := range fields {
+		if err := h.annotate(field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseAddress sets the name of h, and the user and port if given, from an
+// address like name, user@name, name:port or user@name:port. IPv6 addresses
+// need brackets to go with a port, as in [2001:db8::7]:2222.
+func (h *host) parseAddress(addr string) error {
+	if i := strings.LastIndex(addr, "@"); i >= 0 {
+		h.user, addr = addr[:i], addr[i+1:]
+		if h.user == "" {
+			return fmt.Errorf("empty user in %q", addr)
+		}
+	}
+	port := ""
+	switch {
+	case strings.HasPrefix(addr, "["):
+		end := strings.Index(addr, "]")
+		if end < 0 {
+			return fmt.Errorf("missing ] in %q", addr)
+		}
+		rest := addr[end+1:]
+		addr = addr[1:end]
+		if rest != "" {
+			if !strings.HasPrefix(rest, ":") {
+				return fmt.Errorf("unexpected %q after ]", rest)
+			}
+			port = rest[1:]
+		}
+	case strings.Count(addr, ":") == 1:
+		i := strings.Index(addr, ":")
+		addr, port = addr[:i], addr[i+1:]
+	}
+	// Any other address with colons in it is a bare IPv6 address
+	if addr == "" {
+		return fmt.Errorf("missing host name")
+	}
+	h.name = addr
+	if port != "" {
+		return h.annotate("port=" + port)
+	}
+	return nil
+}
+
+// annotate applies a single key=value annotation to the host.
+func (h *host) annotate(field string) error {
+	kv := strings.SplitN(field, "=", 2)
+	if len(kv) != 2 {
+		return fmt.Errorf("malformed annotation %q, expected key=value", field)
+	}
+	key, value := kv[0], kv[1]
+	switch key {
+	case "weight":
+		weight, err := strconv.Atoi(value)
+		if err != nil || weight < 1 {
+			return fmt.Errorf("weight must be a positive integer, got %q", value)
+		}
+		h.weight = weight
+	case "slots":
+		slots, err := strconv.Atoi(value)
+		if err != nil || slots < 1 {
+			return fmt.Errorf("slots must be a positive integer, got %q", value)
+		}
+		h.slots = slots
+	case "labels":
+		labels, err := parseTagList(value)
+		if err != nil {
+			return err
+		}
+		for _, label := range labels {
+			if strings.HasPrefix(label, "!") {
+				return fmt.Errorf("label %q can't be negated", label)
+			}
+			h.labels[label] = true
+		}
+	case "user":
+		h.user = value
+	case "port":
+		port, err := strconv.Atoi(value)
+		if err != nil || port < 1 || port > 65535 {
+			return fmt.Errorf("port must be between 1 and 65535, got %q", value)
+		}
+		h.port = port
+	case "key":
+		h.key = value
+	case "container":
+		h.container = value
+	case "kube-context":
+		h.kubeContext = value
+	case "docker-host":
+		h.dockerHost = value
+	case "ssh-opt":
+		if err := checkSSHOption(value); err != nil {
+			return err
+		}
+		h.sshOpts = append(h.sshOpts, value)
+	case "jump", "bastion":
+		if _, err := parseJump(value); err != nil {
+			return err
+		}
+		h.jump = value
+	default:
+		return fmt.Errorf("unknown annotation %q", key)
+	}
+	return nil
+}
+
+// checkSSHOption checks that opt looks like an option for ssh -o.
+func checkSSHOption(opt string) error {
+	if i := strings.Index(opt, "="); i <= 0 {
+		return fmt.Errorf("ssh option must look like Key=Value, got %q", opt)
+	}
+	return nil
+}
+
+// parseJump parses a jump host spec as taken by ssh -J: a comma separated
+// list of [user@]host[:port], nearest first.
+func parseJump(spec string) ([]*host, error) {
+	var hops []*host
+	for _, hop := range strings.Split(spec, ",") {
+		h := &host{}
+		if err := h.parseAddress(hop); err != nil {
+			return nil, fmt.Errorf("bad jump host %q: %v", hop, err)
+		}
+		hops = append(hops, h)
+	}
+	return hops, nil
+}
+
+// loginDefaults fills in the login settings hosts don't set themselves.
+func loginDefaults(hosts []*host, user string, port int, key, jump string) {
+	for _, h := range hosts {
+		if h.winrm != "" {
+			// Only the user name means the same over WinRM
+			if h.user == "" {
+				h.user = user
+			}
+			continue
+		}
+		if h.jump == "" {
+			h.jump = jump
+		}
+		if h.user == "" {
+			h.user = user
+		}
+		if h.port == 0 {
+			h.port = port
+		}
+		if h.key == "" {
+			h.key = key
+		}
+	}
+}
+
+// excludeHosts drops the hosts whose name matches any of the glob patterns,
+// e.g. "node1[0-4]" or "*.eu-west".
+func excludeHosts(hosts []*host, patterns []string) ([]*host, error) {
+	if len(patterns) == 0 {
+		return hosts, nil
+	}
+	var kept []*host
+	for _, h := range hosts {
+		excluded := false
+		for _, pattern := range patterns {
+			matched, err := path.Match(pattern, h.name)
+			if err != nil {
+				return nil, fmt.Errorf("bad exclude pattern %q: %v", pattern, err)
+			}
+			if matched {
+				excluded = true
+				break
+			}
+		}
+		if excluded {
+			logInfo("EXCLUDE host=%v", h.name)
+			continue
+		}
+		kept = append(kept, h)
+	}
+	return kept, nil
+}
+
+// matches reports whether h is named by, or carries a label from, hints.
+func (h *host) matches(hints []string) bool {
+	for _, hint := range hints {
+		if hint == h.name || h.labels[hint] {
+			return true
+		}
+	}
+	return false
+}
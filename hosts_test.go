@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// writeFiles writes files, by slash separated path, to a new directory and
+// returns its path.
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// describeHost formats what the hosts file said about h, for tests to
+// compare.
+func describeHost(h *host) string {
+	var labels []string
+	for l := range h.labels {
+		labels = append(labels, l)
+	}
+	sort.Strings(labels)
+	return fmt.Sprintf("%v user=%v port=%v weight=%v slots=%v labels=%v", h.name, h.user, h.port, h.weight, h.slots, strings.Join(labels, ","))
+}
+
+func TestParseHosts(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		want  []string // describeHost of every host
+	}{
+		{"bare name", []string{"node1"}, []string{"node1 user= port=0 weight=1 slots=0 labels="}},
+		{"annotations", []string{"bigbox01 weight=4 slots=8 labels=gpu,ssd user=batch port=2222"}, []string{"bigbox01 user=batch port=2222 weight=4 slots=8 labels=gpu,ssd"}},
+		{"user and port", []string{"batch@node1:2222"}, []string{"node1 user=batch port=2222 weight=1 slots=0 labels="}},
+		{"last @ ends the user", []string{"a@b@node1"}, []string{"node1 user=a@b port=0 weight=1 slots=0 labels="}},
+		{"annotations over the address", []string{"batch@node1:2222 user=ops port=22"}, []string{"node1 user=ops port=22 weight=1 slots=0 labels="}},
+		{"bare IPv6", []string{"2001:db8::7"}, []string{"2001:db8::7 user= port=0 weight=1 slots=0 labels="}},
+		{"IPv6 in brackets", []string{"[2001:db8::7]"}, []string{"2001:db8::7 user= port=0 weight=1 slots=0 labels="}},
+		{"IPv6 with a port", []string{"batch@[2001:db8::7]:2222 weight=2"}, []string{"2001:db8::7 user=batch port=2222 weight=2 slots=0 labels="}},
+		{"IPv6 is no group", []string{"[::1]", "node1"}, []string{"::1 user= port=0 weight=1 slots=0 labels=", "node1 user= port=0 weight=1 slots=0 labels="}},
+		{"blank lines and comments", []string{"", "# the web servers", "   ", "web1 # weight=3", "web2 weight=2 #slots=4"}, []string{"web1 user= port=0 weight=1 slots=0 labels=", "web2 user= port=0 weight=2 slots=0 labels="}},
+		{
+			"group annotations and label",
+			[]string{"[eu] user=ops labels=ssd", "eu1", "eu2 user=root labels=gpu"},
+			[]string{"eu1 user=ops port=0 weight=1 slots=0 labels=eu,ssd", "eu2 user=root port=0 weight=1 slots=0 labels=eu,gpu,ssd"},
+		},
+		{
+			"group up to the next one",
+			[]string{"lone", "[eu] slots=2", "eu1", "[us]", "us1"},
+			[]string{"lone user= port=0 weight=1 slots=0 labels=", "eu1 user= port=0 weight=1 slots=2 labels=eu", "us1 user= port=0 weight=1 slots=0 labels=us"},
+		},
+		{"empty group", []string{"[eu]"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hosts, err := parseHosts("hosts", tt.lines)
+			if err != nil {
+				t.Fatalf("parseHosts(%q) = %v", tt.lines, err)
+			}
+			var got []string
+			for _, h := range hosts {
+				got = append(got, describeHost(h))
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("parseHosts(%q) =\n%v\nwant\n%v", tt.lines, strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestParseHostsErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		want  string
+	}{
+		{"empty user", []string{"@node1"}, "hosts line 1: empty user"},
+		{"missing bracket", []string{"good", "[2001:db8::7:22"}, "hosts line 2: missing ]"},
+		{"junk after bracket", []string{"[2001:db8::7]22"}, `unexpected "22" after ]`},
+		{"no name", []string{"batch@:22"}, "missing host name"},
+		{"bad port", []string{"node1:ssh"}, "port must be between 1 and 65535"},
+		{"port out of range", []string{"node1 port=70000"}, "port must be between 1 and 65535"},
+		{"bad weight", []string{"node1 weight=0"}, "weight must be a positive integer"},
+		{"bad slots", []string{"node1 slots=many"}, "slots must be a positive integer"},
+		{"negated label", []string{"node1 labels=!gpu"}, `label "!gpu" can't be negated`},
+		{"not key=value", []string{"node1 fast"}, `malformed annotation "fast"`},
+		{"unknown annotation", []string{"node1 speed=fast"}, `unknown annotation "speed"`},
+		{"bad group line without hosts", []string{"[eu] weight=none"}, "hosts line 1: weight must be a positive integer"},
+		{"bad ssh option", []string{"node1 ssh-opt=Compression"}, "ssh option must look like Key=Value"},
+		{"bad jump host", []string{"node1 jump=@bastion"}, "bad jump host"},
+		{"include without a file", []string{"%include"}, "hosts line 1: %include needs a single file"},
+		{"include of two files", []string{"%include a b"}, "hosts line 1: %include needs a single file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseHosts("hosts", tt.lines); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("parseHosts(%q) = %v, want an error with %q", tt.lines, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseHostsInclude(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		lines []string
+		want  []string // host names
+		err   string   // regexp the error matches, if there is one
+	}{
+		{
+			name:  "in place of the line",
+			files: map[string]string{"more.hosts": "b\nc\n"},
+			lines: []string{"a", "%include more.hosts", "d"},
+			want:  []string{"a", "b", "c", "d"},
+		},
+		{
+			name:  "relative to the including file",
+			files: map[string]string{"sub/one.hosts": "b\n%include two.hosts\n", "sub/two.hosts": "c\n"},
+			lines: []string{"a", "%include sub/one.hosts"},
+			want:  []string{"a", "b", "c"},
+		},
+		{
+			name:  "missing file",
+			lines: []string{"a", "%include gone.hosts"},
+			err:   `^.*hosts line 2: .*gone\.hosts`,
+		},
+		{
+			name:  "including itself",
+			files: map[string]string{"loop.hosts": "a\n%include loop.hosts\n"},
+			lines: []string{"%include loop.hosts"},
+			err:   `loop\.hosts line 2: %include of .*loop\.hosts includes itself`,
+		},
+		{
+			name:  "a cycle",
+			files: map[string]string{"one.hosts": "%include two.hosts\n", "two.hosts": "%include one.hosts\n"},
+			lines: []string{"%include one.hosts"},
+			err:   `two\.hosts line 1: %include of .*one\.hosts includes itself`,
+		},
+		{
+			name:  "errors name the included file",
+			files: map[string]string{"more.hosts": "good\nbad weight=0\n"},
+			lines: []string{"%include more.hosts"},
+			err:   `more\.hosts line 2: weight must be a positive integer`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeFiles(t, tt.files)
+			hosts, err := parseHosts(filepath.Join(dir, "hosts"), tt.lines)
+			if tt.err != "" {
+				if err == nil || !regexp.MustCompile(tt.err).MatchString(err.Error()) {
+					t.Errorf("parseHosts(%q) = %v, want an error matching %q", tt.lines, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseHosts(%q) = %v", tt.lines, err)
+			}
+			var got []string
+			for _, h := range hosts {
+				got = append(got, h.name)
+			}
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("parseHosts(%q) = %v, want %v", tt.lines, got, tt.want)
+			}
+		})
+	}
+}
+
+// A group started in an included file must not carry on past the %include
+// line, in place of the group the line is in.
+func TestParseHostsIncludedGroupEnds(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"more.hosts": "c\n[us] user=dev\nd\n",
+	})
+	lines := []string{"[eu] user=ops", "a", "%include more.hosts", "b"}
+	hosts, err := parseHosts(filepath.Join(dir, "hosts"), lines)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct{ name, group, user string }{
+		{"a", "eu", "ops"},
+		{"c", "eu", "ops"},
+		{"d", "us", "dev"},
+		{"b", "eu", "ops"},
+	}
+	if len(hosts) != len(want) {
+		t.Fatalf("parsed %v hosts, want %v", len(hosts), len(want))
+	}
+	for i, w := range want {
+		h := hosts[i]
+		if h.name != w.name || h.user != w.user || len(h.labels) != 1 || !h.labels[w.group] {
+			t.Errorf("host %v = %v user=%q labels=%v, want %v user=%q labels=%v", i, h.name, h.user, h.labels, w.name, w.user, w.group)
+		}
+	}
+}
+
+func TestExcludeHosts(t *testing.T) {
+	names := []string{"node10", "node14", "node15", "db1.eu-west", "db2.us-east"}
+	tests := []struct {
+		name     string
+		patterns []string
+		want     []string
+	}{
+		{"no patterns", nil, names},
+		{"exact name", []string{"node14"}, []string{"node10", "node15", "db1.eu-west", "db2.us-east"}},
+		{"character range", []string{"node1[0-4]"}, []string{"node15", "db1.eu-west", "db2.us-east"}},
+		{"star", []string{"*.eu-west"}, []string{"node10", "node14", "node15", "db2.us-east"}},
+		{"question mark", []string{"db?.*"}, []string{"node10", "node14", "node15"}},
+		{"any of several", []string{"node10", "*.us-east"}, []string{"node14", "node15", "db1.eu-west"}},
+		{"everything", []string{"*"}, nil},
+		{"nothing matches", []string{"web*"}, names},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var hosts []*host
+			for _, name := range names {
+				hosts = append(hosts, &host{name: name})
+			}
+			kept, err := excludeHosts(hosts, tt.patterns)
+			if err != nil {
+				t.Fatalf("excludeHosts(%q) = %v", tt.patterns, err)
+			}
+			var got []string
+			for _, h := range kept {
+				got = append(got, h.name)
+			}
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("excludeHosts(%q) kept %v, want %v", tt.patterns, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExcludeHostsBadPattern(t *testing.T) {
+	hosts := []*host{{name: "node1"}}
+	if _, err := excludeHosts(hosts, []string{"node[1"}); err == nil || !strings.Contains(err.Error(), `bad exclude pattern "node[1"`) {
+		t.Errorf("excludeHosts(node[1) = %v, want a bad pattern error", err)
+	}
+}
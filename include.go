@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// How deep %include lines can nest, which only a mistake would reach
+const maxIncludeDepth = 16
+
+// includeDirective returns the file a "%include <file>" line of the file from
+// names, relative to the directory of from, and whether line is one.
+func includeDirective(from, line string) (string, bool) {
+	fields := strings.Fields(line)
+	if len(fields) != 2 || fields[0] != "%include" {
+		return "", false
+	}
+	path := fields[1]
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(from), path)
+	}
+	return path, true
+}
+
+// readInclude reads the lines of the file at path that from includes.
+// included holds the files being included on the way to from; it is
+// returned with from added, for the lines of path to be parsed with.
+func readInclude(path, from string, included []string) ([]string, []string, error) {
+	stack := append(append([]string(nil), included...), from)
+	if len(stack) > maxIncludeDepth {
+		return nil, nil, fmt.Errorf("%%include nested more than %v deep", maxIncludeDepth)
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, f := range stack {
+		if a, err := filepath.Abs(f); err == nil && a == abs {
+			return nil, nil, fmt.Errorf("%%include of %v includes itself", path)
+		}
+	}
+	lines, err := readLines(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return lines, stack, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// States of a command in the journal. Commands with no entry are pending.
+const (
+	stateRunning   = "running"
+	stateSucceeded = "succeeded"
+	stateFailed    = "failed"
+)
+
+// A journalEntry is one line of the journal.
+type journalEntry struct {
+	ID      int    `json:"id"`
+	State   string `json:"state"`
+	Host    string `json:"host,omitempty"`
+	Attempt int    `json:"attempt"`
+	Line    string `json:"line"` // the commands file line, to tell if it changed since
+}
+
+// A journal records the progress of every command in a file, one JSON entry
+// per line, so that a run that died halfway can be resumed. Entries are only
+// ever appended and the last one for a command wins. A nil journal records
+// nothing.
+type journal struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+// openJournal opens the journal at path for this run. When resuming, the
+// entries already in it are kept and the last entry of every command is
+// returned; otherwise the file starts out empty.
+func openJournal(path string, resume bool) (*journal, map[int]journalEntry, error) {
+	last := make(map[int]journalEntry)
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if resume {
+		lines, err := readLines(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, nil, err
+		}
+		for _, line := range lines {
+			var e journalEntry
+			if json.Unmarshal([]byte(line), &e) != nil {
+				// Most likely the last line, cut short by the crash
+				continue
+			}
+			last[e.ID] = e
+		}
+	} else {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &journal{f: f, enc: json.NewEncoder(f)}, last, nil
+}
+
+// record appends an entry for attempt number attempt of j. Entries that end
+// an attempt are synced to disk so they survive a crash of the machine.
+func (jl *journal) record(j *job, state string, h *host, attempt int) {
+	if jl == nil {
+		return
+	}
+	e := journalEntry{ID: j.id, State: state, Attempt: attempt, Line: j.line}
+	if h != nil {
+		e.Host = h.name
+	}
+	jl.mu.Lock()
+	defer jl.mu.Unlock()
+	if err := jl.enc.Encode(e); err != nil {
+		logError("ERROR could not write to the journal: %v", err)
+		return
+	}
+	if state != stateRunning {
+		jl.f.Sync()
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"time"
+)
+
+// Host name prefix of hosts that are pods rather than machines, e.g.
+// k8s://build/runner-0. Commands run in the pod through kubectl exec.
+const k8sScheme = "k8s://"
+
+// kubectlExecutor runs commands through sh in the pod of the host. Cancelling
+// ctx only drops the stream, like dropping an ssh connection; stopping the
+// command itself goes through its pid file, as it does over ssh.
+type kubectlExecutor struct{}
+
+func (kubectlExecutor) run(ctx context.Context, h *host, command string, opts runOptions, stdout, stderr io.Writer) (exitStatus, error) {
+	args := []string{"exec", "--namespace", h.namespace, h.pod}
+	if h.kubeContext != "" {
+		args = append([]string{"--context", h.kubeContext}, args...)
+	}
+	if h.container != "" {
+		args = append(args, "--container", h.container)
+	}
+	if opts.stdin != nil || opts.pty {
+		// kubectl only allocates a terminal for interactive sessions
+		args = append(args, "--stdin")
+	}
+	if opts.pty {
+		args = append(args, "--tty")
+	}
+	// kubectl exec has no way to pass variables but env in the pod
+	args = append(args, "--", "env")
+	args = append(args, commandEnv...)
+	args = append(args, "sh", "-c", command)
+	cmd := exec.CommandContext(ctx, "kubectl", args...)
+	logTrace("KUBECTL host=%v args=%q", h.name, args)
+	cmd.Stdin = opts.stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.WaitDelay = time.Second
+	// kubectl passes on the status of the command, but can't tell it apart
+	// from its own failures, which all exit with 1
+	return processStatus(cmd.Run())
+}
+
+// checkPods checks that the pods among hosts exist, since a missing pod
+// would otherwise pass for a command exiting with status 1.
+func checkPods(hosts []*host) error {
+	for _, h := range hosts {
+		if h.pod == "" {
+			continue
+		}
+		args := []string{"get", "pod", "--namespace", h.namespace, h.pod, "--output", "name"}
+		if h.kubeContext != "" {
+			args = append([]string{"--context", h.kubeContext}, args...)
+		}
+		if out, err := exec.Command("kubectl", args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("%v: %v: %s", h.name, err, out)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// How long a remote command gets to exit after SIGTERM before its ssh
+// connection is dropped
+const killGrace = 10 * time.Second
+
+// A remoteProcess is an attempt of a command on a host that disgo may need to
+// stop early. Killing the local ssh process alone would leave the command
+// running on the host, so the remote shell first records its pid in a pid
+// file. It runs as the leader of the session's process group, so a second ssh
+// session can signal the whole group.
+type remoteProcess struct {
+	host     *host
+	pidFile  string
+	cancel   context.CancelFunc // drops the ssh connection
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// newRemoteProcess prepares attempt number attempt of job id on h. cancel
+// must cancel the context the attempt runs under.
+func newRemoteProcess(h *host, id, attempt int, cancel context.CancelFunc) *remoteProcess {
+	return &remoteProcess{
+		host:    h,
+		pidFile: fmt.Sprintf("/tmp/disgo-%v-%v-%v.pid", os.Getpid(), id, attempt),
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+}
+
+// wrap returns command prefixed so that the remote shell records its pid
+// before running it, and cleans up after itself.
+func (rp *remoteProcess) wrap(command string) string {
+	if rp.host.winrm != "" {
+		// Not a POSIX shell; WinRM stops commands itself
+		return command
+	}
+	return fmt.Sprintf("trap 'rm -f %[1]v' EXIT; echo $$ > %[1]v; %[2]v", rp.pidFile, command)
+}
+
+// finished must be called once the attempt's ssh process has exited.
+func (rp *remoteProcess) finished() {
+	close(rp.done)
+}
+
+// stop sends SIGTERM to the remote process group, and drops the connection
+// if the attempt is still running after the grace period. It returns right
+// away; the attempt itself sees the command exit.
+func (rp *remoteProcess) stop() {
+	rp.stopOnce.Do(func() {
+		if rp.host.image != "" || rp.host.winrm != "" {
+			// Every command gets its own container, there's no reaching
+			// it with another one. Stopping the container gives it the
+			// same grace period. WinRM has a signal to stop a command.
+			rp.cancel()
+			return
+		}
+		go func() {
+			kill := fmt.Sprintf("kill -s TERM -- -$(cat %v) 2>/dev/null", rp.pidFile)
+			ctx, cancel := context.WithTimeout(context.Background(), killGrace)
+			defer cancel()
+			if err := tryCommand(ctx, kill, rp.host, io.Discard); err != nil {
+				logError("ERROR could not signal %v on host=%v: %v", rp.pidFile, rp.host.name, err)
+			}
+			select {
+			case <-rp.done:
+			case <-time.After(killGrace):
+				rp.cancel()
+			}
+		}()
+	})
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Host name that runs commands on this machine rather than over ssh
+const localHost = "localhost"
+
+// localExecutor runs commands through sh on this machine. Like a remote
+// shell, each leads its own process group, so stopping it stops everything
+// it started.
+type localExecutor struct{}
+
+func (localExecutor) run(ctx context.Context, h *host, command string, opts runOptions, stdout, stderr io.Writer) (exitStatus, error) {
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	if opts.pty {
+		if err := checkScript(); err != nil {
+			return 0, err
+		}
+		// util-linux script runs the command on a terminal of its own
+		cmd = exec.CommandContext(ctx, "script", "--quiet", "--return", "--command", command, "/dev/null")
+	}
+	if len(commandEnv) > 0 {
+		cmd.Env = append(os.Environ(), commandEnv...)
+	}
+	logTrace("LOCAL args=%q", cmd.Args)
+	cmd.Stdin = opts.stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	inProcessGroup(cmd)
+	// Don't wait on background processes holding our pipes
+	cmd.WaitDelay = time.Second
+	return processStatus(cmd.Run())
+}
+
+// anyPTY reports whether any of jobs runs on a pseudo-terminal, with -pty
+// set as pty.
+func anyPTY(jobs []*job, pty bool) bool {
+	for _, j := range jobs {
+		if j.pty == nil && pty || j.pty != nil && *j.pty {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	scriptOnce sync.Once
+	scriptErr  error
+)
+
+// checkScript returns an error unless the script command here is the one
+// from util-linux, the only one with the options used for -pty. The script
+// of BSD and macOS takes others.
+func checkScript() error {
+	scriptOnce.Do(func() {
+		out, err := exec.Command("script", "--version").CombinedOutput()
+		if err != nil || !strings.Contains(string(out), "util-linux") {
+			scriptErr = errors.New("-pty on this machine needs script from util-linux")
+		}
+	})
+	return scriptErr
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os/exec"
+
+// inProcessGroup leaves cmd as it is: without process groups, cancelling it
+// kills only the process itself.
+func inProcessGroup(cmd *exec.Cmd) {}
@@ -0,0 +1,45 @@
+package main
+
+import "log"
+
+// Log levels, from least to most said. Each message is a line starting with
+// a tag saying what it is about, e.g. "EXEC command id=3 host=bigbox01".
+const (
+	levelError  = iota // what went wrong, for -q
+	levelInfo          // how the run is going, by default
+	levelDetail        // every attempt of every command, for -v
+	levelTrace         // how commands reach hosts, for -vv
+)
+
+// logLevel is the most detailed level logged
+var logLevel = levelInfo
+
+func logAt(level int, format string, args ...interface{}) {
+	if level > logLevel {
+		return
+	}
+	log.Printf(format+"\n", args...)
+	logSyslog(level, format, args...)
+}
+
+func logError(format string, args ...interface{}) {
+	logAt(levelError, format, args...)
+}
+
+func logInfo(format string, args ...interface{}) {
+	logAt(levelInfo, format, args...)
+}
+
+func logDetail(format string, args ...interface{}) {
+	logAt(levelDetail, format, args...)
+}
+
+func logTrace(format string, args ...interface{}) {
+	logAt(levelTrace, format, args...)
+}
+
+// tracing reports whether trace messages are logged, for callers to skip
+// the work of putting them together.
+func tracing() bool {
+	return logLevel >= levelTrace
+}
@@ -8,71 +8,27 @@ import (
 	"flag"
 	"fmt"
 	"io"
-	"log"
-	"math/rand"
 	"os"
-	"os/exec"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
-)
-
-func debug(format string, args ...interface{}) {
-	fullFormat := fmt.Sprintf("%v\n", format)
-	log.Printf(fullFormat, args...)
-}
-
-// Channel to communicate back on
-func tryCommand(remoteCommand string, host string, outf io.Writer) error {
-	cmd := exec.Command("ssh", "-o", "ConnectTimeout=2", host, remoteCommand)
-	cmd.Stdout = outf
-	cmd.Stderr = outf
-	err := cmd.Run()
-	if err != nil {
-		return err
-	}
-	return nil
-}
 
-// Dispatch a given command to one of a set of available servers. If the command fails,
-// attempt to try it again on a different server.
-func dispatch(id int, command string, hosts []string, doneChan chan bool) {
-	// Try hosts in a random order until one works
-	order := rand.Perm(len(hosts))
-	attempts := 0
-	for _, i := range order {
-		host := hosts[i]
-		// Write out an attempt file for this command
-		attemptOutputPath := fmt.Sprintf("cmd_%v-attempt%v.log", id, attempts)
-		attempts++
-		outf, err := os.Create(attemptOutputPath)
-		if err != nil {
-			// Not sure how to recover from this, likely the FS is damaged or OOS.
-			panic(err)
-		}
-		debug("EXEC command id=%v host=%v", id, host)
-		if err := tryCommand(command, host, outf); err != nil {
-			debug("ERROR id=%v status=%v", id, err)
-			continue
-		}
-		// If successful, do an atomic rename of the attempt to the final output
-		finalOutputPath := fmt.Sprintf("cmd_%v-final.log", id)
-		if os.Rename(attemptOutputPath, finalOutputPath) != nil {
-			// Issue on rename, FS errors can be hard to recover from.
-			// Instead of failing, just print an error and move on
-			debug("ERROR (id=%v): could not write output path %v, final output in %v", id, finalOutputPath, attemptOutputPath)
-		}
-		debug("SUCC id=%v output=%v", id, attemptOutputPath)
-		doneChan <- true
-		return
-	}
-	debug("FAILED id=%v exhausted all servers and could not complete", id)
-	doneChan <- false
-}
+	"github.com/a10y/disgo/scheduler"
+	"github.com/a10y/disgo/sshclient"
+)
 
-// Read all lines from a file
+// Read all lines from a file, or from stdin if path is -
 func readLines(path string) ([]string, error) {
-	f, err := os.Open(path)
-	if err != nil {
-		return nil, err
+	f := os.Stdin
+	if path != "-" {
+		var err error
+		if f, err = os.Open(path); err != nil {
+			return nil, err
+		}
+		defer f.Close()
 	}
 	scanner := bufio.NewScanner(f)
 	var lines []string
@@ -82,48 +38,976 @@ func readLines(path string) ([]string, error) {
 	return lines, scanner.Err()
 }
 
+// stringList is a flag that can be given more than once
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
 // Arguments to commands
 var (
-	cmdsFilePath  string
+	cmdsFilePaths stringList
 	hostsFilePath string
+	maxPerHost    int
+	parallel      int
+	schedule      string
+	steal         bool
+	dispatchRate  float64
+	maxLoad       float64
+	loadInterval  time.Duration
+	deadline      time.Duration
+	seed          int64
+	exclude       stringList
+	maxAttempts   int
+	adaptive      bool
+	backfill      time.Duration
+	preempt       bool
+	canary        int
+	retries       int
+	backoff       scheduler.Backoff
+	sameHost      int
+	circuitFails  int
+	circuitCool   time.Duration
+	quarantineN   int
+	reprobeEvery  time.Duration
+	retryOnExit   string
+	timeout       time.Duration
+	runDeadline   time.Duration
+	runGrace      time.Duration
+	onFailure     string
+	failedPath    string
+	requeuePasses int
+	healthCheck   bool
+	healthCmd     string
+	healthTimeout time.Duration
+	stallTimeout  time.Duration
+	journalPath   string
+	resume        bool
+	avoidFlaky    bool
+	perHostCap    int
+	maxHostFails  int
+	failedLogs    string
+	transport     string
+	sshUser       string
+	sshPort       int
+	sshKey        string
+	jumpHosts     string
+	reuseConns    bool
+	hostKeys      string
+	passwordFile  string
+	askPassword   bool
+	gssapi        bool
+	gssDelegate   bool
+	sshOpts       stringList
+	local         bool
+	warmUpHosts   bool
+	warmUpTimeout time.Duration
+	becomeRoot    bool
+	becomeAs      string
+	becomePwFile  string
+	askBecomePw   bool
+	envVars       stringList
+	envFile       string
+	chdir         string
+	pty           bool
+	compression   bool
+	ciphers       string
+	outputDir     string
+	runID         string
+	combinedOut   bool
+	stream        bool
+	eventsPath    string
+	compressLogs  bool
+	keepAttempts  bool
+	archiveOld    bool
+	quiet         bool
+	verbose       bool
+	veryVerbose   bool
+	tee           bool
+	outputPath    string
+	timestamps    bool
+	syslogAddr    string
+	syslogTag     string
+	mergedPath    string
+	maxOutput     string
+	stripANSI     bool
+	uploadDest    string
+	csvPath       string
+	junitPath     string
+	htmlPath      string
+	hostLogsOn    bool
+	digestLines   int
+	sweepArgs     stringList
+	watch         bool
+	quoting       string
+	scripts       bool
+	winrmHTTP     bool
 )
 
 func main() {
-	flag.StringVar(&cmdsFilePath, "cmds", "cmds.txt", "Files with commands to run, one per line")
-	flag.StringVar(&hostsFilePath, "hosts", "hosts.txt", "Path to hosts file")
+	if os.Getenv(askpassEnv) != "" {
+		askpass()
+		return
+	}
+	flag.Var(&cmdsFilePaths, "cmds", "Files with commands to run, one per line (default cmds.txt), - for stdin, or as a list of entries with a command and its settings in .json, .yaml or .yml files. Repeat to share the hosts fairly between several files")
+	flag.StringVar(&hostsFilePath, "hosts", "hosts.txt", "Path to hosts file. A host named localhost runs its commands on this machine without ssh")
+	flag.Var(&sweepArgs, "sweep", "Parameter to sweep over, as name=v1,v2 or name=1..10: every command line runs once for each combination of the values of every -sweep, with {name} replaced by the value. May be repeated")
+	flag.BoolVar(&watch, "watch", false, "Keep watching the commands files for lines appended to them and run those too, until interrupted. Lines are taken once they end in a newline")
+	flag.StringVar(&quoting, "quote", "raw", "How commands reach the host's shell: raw hands them to the login shell as written, safe sends them base64-encoded to run with sh byte for byte, quotes, $ and globs included (needs base64 on the hosts)")
+	flag.BoolVar(&scripts, "scripts", false, "Take every command as the path of a local script followed by its arguments. The script is copied to the host, run there and removed, so it can be as long as it needs to be, up to 64KiB. Not for winrm:// hosts")
+	flag.BoolVar(&local, "local", false, "Run every command on this machine instead of the hosts in -hosts, as a local parallel runner")
+	flag.IntVar(&maxPerHost, "max-per-host", 0, "Maximum number of commands to run concurrently on each host (0 for unlimited)")
+	flag.IntVar(&parallel, "parallel", 32, "Maximum number of commands to run concurrently across all hosts")
+	flag.StringVar(&schedule, "schedule", scheduleRandom, "Host selection policy: random, roundrobin or leastloaded")
+	flag.BoolVar(&steal, "steal", false, "Let idle hosts steal commands queued up for busy hosts")
+	flag.Float64Var(&dispatchRate, "dispatch-rate", 0, "Maximum number of commands to dispatch per second (0 for unlimited)")
+	flag.Float64Var(&maxLoad, "max-load", 0, "Skip hosts whose 1 minute load average is above this (0 to not probe load)")
+	flag.DurationVar(&loadInterval, "load-probe-interval", 30*time.Second, "How often to re-probe host load averages with -max-load")
+	flag.DurationVar(&deadline, "deadline", 0, "Expected time budget for the whole run. Commands with #duration hints are started longest first to fit it")
+	flag.Int64Var(&seed, "seed", 0, "Seed for random host selection, to replay the placement of an earlier run (0 picks one)")
+	flag.Var(&exclude, "exclude", "Comma separated hosts or glob patterns to leave out of the pool, e.g. node07,gpu-*. May be repeated")
+	flag.IntVar(&maxAttempts, "max-total-attempts", 0, "Maximum number of attempts across all commands; once spent, remaining commands fail fast (0 for unlimited)")
+	flag.BoolVar(&adaptive, "adaptive", false, "Adapt each host's concurrency: start at 1 and grow while commands succeed quickly, halve when they can't connect or time out. Slot limits and -parallel are the ceiling")
+	flag.DurationVar(&backfill, "backfill", 0, "Let commands with a #duration hint up to this long run alongside commands that have been running longer than it, even on a full host")
+	flag.BoolVar(&preempt, "preempt", false, "Stop and requeue lower priority commands (SIGTERM on the remote side) when higher priority ones are waiting for their host")
+	flag.IntVar(&retries, "retries", -1, "Maximum number of times to retry each command that exits with an error (-1 to try it on every host). Hosts that can't be reached are always skipped without spending a retry")
+	flag.DurationVar(&backoff.Base, "backoff", 0, "How long to wait before retrying a failed command (0 to retry right away)")
+	flag.Float64Var(&backoff.Multiplier, "backoff-multiplier", 2, "Factor the -backoff delay grows by with every further retry of a command")
+	flag.DurationVar(&backoff.Max, "backoff-max", 5*time.Minute, "Longest delay between retries of a command (0 for no cap)")
+	flag.Float64Var(&backoff.Jitter, "backoff-jitter", 0.2, "Fraction by which to randomly lengthen or shorten every -backoff delay, so commands that failed together don't retry in lockstep")
+	flag.IntVar(&sameHost, "retry-same-host", 0, "Number of times to retry a failed command on the same host before failing over to another one")
+	flag.IntVar(&circuitFails, "circuit-failures", 0, "Stop sending commands to a host after this many connection failures in a row, until -circuit-cooldown has passed (0 to disable)")
+	flag.DurationVar(&circuitCool, "circuit-cooldown", time.Minute, "How long a host rests after -circuit-failures before a single probe command is let through")
+	flag.IntVar(&quarantineN, "quarantine", 0, "Quarantine a host after this many connection failures in a row, and re-probe it with `ssh host true` until it answers (0 to disable)")
+	flag.DurationVar(&reprobeEvery, "quarantine-probe-interval", 30*time.Second, "How often to re-probe quarantined hosts")
+	flag.StringVar(&retryOnExit, "retry-on-exit", "", "Comma separated exit statuses that get a command retried, e.g. 75,137. Any other non-zero status is a permanent failure (default retries on every status)")
+	flag.DurationVar(&timeout, "timeout", 0, "How long each attempt of a command may run before it is killed on the remote side and retried (0 for no limit). A #timeout= hint overrides it per command")
+	flag.DurationVar(&runDeadline, "run-deadline", 0, "Stop dispatching commands, retries included, this long after the start of the run (0 for no limit)")
+	flag.DurationVar(&runGrace, "run-deadline-grace", time.Minute, "How long commands still running at the -run-deadline get to finish before disgo exits without them")
+	flag.StringVar(&onFailure, "on-failure", "", "Local shell command to run whenever a command fails for good, e.g. 'page.sh {id} {host} {exit}'. {command} is replaced too")
+	flag.StringVar(&failedPath, "failed-cmds", "failed_cmds.txt", "File to write the commands that did not succeed to, in commands file format, so it can be fed back in with -cmds (\"\" to not write one)")
+	flag.IntVar(&requeuePasses, "requeue-failed", 0, "Number of extra passes to make over the commands that failed once everything else is done")
+	flag.BoolVar(&healthCheck, "health-check", false, "Check every host in parallel before dispatching anything, and leave out the ones that fail")
+	flag.StringVar(&healthCmd, "health-check-cmd", probeCommand, "Command that must succeed on a host for -health-check to keep it")
+	flag.DurationVar(&healthTimeout, "health-check-timeout", 10*time.Second, "How long -health-check waits for each host")
+	flag.DurationVar(&stallTimeout, "stall-timeout", 0, "Kill and retry an attempt that produces no output for this long (0 to never consider output stalled)")
+	flag.StringVar(&journalPath, "journal", "disgo.journal", "File to record the progress of every command in, for -resume (\"\" to not keep one)")
+	flag.BoolVar(&resume, "resume", false, "Continue an earlier run from its -journal: commands that already succeeded are not run again")
+	flag.BoolVar(&avoidFlaky, "avoid-flaky", true, "Give less work to hosts with a poor recent success rate or that run slower than the rest")
+	flag.IntVar(&perHostCap, "max-attempts-per-host", 0, "Most attempts of any one command on the same host, counting -retry-same-host retries and preemptions (0 for no cap)")
+	flag.IntVar(&maxHostFails, "max-host-failures", 0, "Drop a host from the run once this many attempts have failed on it (0 to never drop hosts)")
+	flag.StringVar(&failedLogs, "failed-logs", failedLogsKeep, "What to do with the output of failed attempts: keep, gzip or delete")
+	flag.StringVar(&transport, "transport", "exec", "How to reach hosts: exec runs the ssh binary, native uses the built in SSH client with the keys in ~/.ssh")
+	flag.StringVar(&sshUser, "ssh-user", "", "User to log in to hosts as, unless the hosts file says otherwise with user=")
+	flag.IntVar(&sshPort, "ssh-port", 0, "Port to connect to hosts on, unless the hosts file says otherwise with port= (0 for ssh's default)")
+	flag.StringVar(&sshKey, "ssh-key", "", "Private key file to log in with, unless the hosts file says otherwise with key=")
+	flag.StringVar(&jumpHosts, "jump", "", "Jump hosts to reach hosts through, as for ssh -J: [user@]host[:port], comma separated, unless the hosts file says otherwise with jump=")
+	flag.BoolVar(&reuseConns, "reuse-connections", true, "Keep one SSH connection open per host and run every command over it, through ControlMaster with -transport exec")
+	flag.StringVar(&hostKeys, "host-key-checking", "strict", "What to do with hosts missing from ~/.ssh/known_hosts: strict refuses them, accept-new adds their key, off skips checking keys at all")
+	flag.StringVar(&passwordFile, "ssh-password-file", "", "File whose first line is the SSH password, for hosts that don't take our keys, and the password for winrm:// hosts. Otherwise it is read from $"+passwordEnv+" if set")
+	flag.BoolVar(&winrmHTTP, "winrm-insecure", false, "Allow winrm:// hosts, which are sent the password in the clear over plain HTTP. Use winrms:// instead where the host has HTTPS")
+	flag.BoolVar(&askPassword, "ssh-password-prompt", false, "Prompt once for the SSH password, for hosts that don't take our keys")
+	flag.BoolVar(&gssapi, "gssapi", false, "Log in with GSSAPI, i.e. Kerberos tickets from kinit. Needs -transport exec")
+	flag.BoolVar(&gssDelegate, "gssapi-delegate", false, "Forward Kerberos credentials to hosts with -gssapi, so commands can reach other kerberized services")
+	flag.Var(&sshOpts, "ssh-opt", "Option for the ssh binary, as for ssh -o, e.g. -ssh-opt ServerAliveInterval=15. Repeat for several. Hosts can add their own with ssh-opt=")
+	flag.BoolVar(&warmUpHosts, "warm-up", false, "Connect to every host in parallel before dispatching anything, report which are reachable, and give up if none are")
+	flag.DurationVar(&warmUpTimeout, "warm-up-timeout", 10*time.Second, "How long -warm-up waits for each host")
+	flag.BoolVar(&becomeRoot, "become", false, "Run remote commands through sudo as -become-user")
+	flag.StringVar(&becomeAs, "become-user", "root", "User to run remote commands as with -become")
+	flag.StringVar(&becomePwFile, "become-password-file", "", "File whose first line is the sudo password for -become. Otherwise it is read from $"+becomePasswordEnv+" if set, and sudo must not need one if not")
+	flag.BoolVar(&askBecomePw, "become-password-prompt", false, "Prompt once for the sudo password for -become")
+	flag.Var(&envVars, "env", "KEY=VALUE to set in the environment of remote commands. Repeat for several. Over ssh, the host's sshd must AcceptEnv them")
+	flag.StringVar(&envFile, "env-file", "", "File of KEY=VALUE lines to set in the environment of remote commands, as for -env")
+	flag.StringVar(&chdir, "chdir", "", "Remote directory to run commands in, created if missing, unless a command says otherwise with #chdir=")
+	flag.BoolVar(&pty, "pty", false, "Run commands on a pseudo-terminal, for tools that behave differently without one, unless a command says otherwise with #pty=. Commands on this machine need script from util-linux for it. Not with a -become password, which the terminal would echo")
+	flag.BoolVar(&compression, "compression", false, "Compress SSH connections, which pays off for commands with a lot of output over slow links. Needs -transport exec")
+	flag.StringVar(&ciphers, "ciphers", "", "Comma separated SSH ciphers to offer, most preferred first, e.g. aes128-gcm@openssh.com,chacha20-poly1305@openssh.com")
+	flag.StringVar(&outputDir, "output-dir", "disgo-runs", "Directory to write the output of runs to, each in a directory of its own named after -run-id")
+	flag.StringVar(&runID, "run-id", "", "Name of the directory of this run in -output-dir (default the start time). Give -resume the same name to carry on writing where the run left off")
+	flag.BoolVar(&combinedOut, "combined-output", false, "Write the stdout and stderr of each attempt interleaved to a single output file, instead of to separate stdout and stderr files")
+	flag.BoolVar(&stream, "stream", false, "Also print the output of commands to the terminal as it comes, a line at a time with each line prefixed by [id@host]")
+	flag.StringVar(&eventsPath, "events", "events.jsonl", "File to write an event for every attempt started, failed or succeeded to, as JSON Lines. Relative to the run's directory in -output-dir (\"\" to not write one)")
+	flag.BoolVar(&compressLogs, "compress-logs", false, "Gzip the output of attempts as it is written, into files with a .gz suffix")
+	flag.BoolVar(&keepAttempts, "keep-attempts", false, "Keep the output of the failed attempts of commands that succeed in the end, instead of removing it once they do")
+	flag.BoolVar(&archiveOld, "archive-attempts", false, "Pack the output of the failed attempts of commands that succeed in the end into attempts.tar.gz in the command's directory before removing it")
+	flag.StringVar(&outputPath, "output", "", "Where to put the final output of every command as well, as a template like '{dir}/{label}-{stream}.log'. {dir} is the run's directory, {run} its id, {id} and {label} name the command (#label=, its id by default), {host} and {attempt} the attempt that succeeded and {stream} is stdout or stderr, or output with -combined-output")
+	flag.BoolVar(&timestamps, "timestamps", false, "Start every line written to output files with the time it was printed, to the microsecond")
+	flag.BoolVar(&hostLogsOn, "host-logs", false, "Also write a log per host to hosts/<host>.log in the run's directory, with the output of every attempt run on the host one after the other as they end")
+	flag.StringVar(&mergedPath, "merged-log", "", "File to write every line of output of every attempt to as well, in the order they were printed, each line starting with its time and [id@host]. Relative to the run's directory in -output-dir")
+	flag.StringVar(&maxOutput, "max-output-size", "", "Most output to keep in each output file of an attempt, like 500K, 100M or 2G. Past it only the start and the end are kept, half each, with a marker in between. The end is kept in a hidden file next to the output until the attempt is over")
+	flag.BoolVar(&stripANSI, "strip-ansi", false, "Leave ANSI escape sequences, such as colors, out of output files")
+	flag.StringVar(&uploadDest, "upload", "", "Copy the metadata and final output of every command to object storage as it finishes, and the run's logs and reports at the end, under an s3://bucket/prefix or gs://bucket/prefix URL. Files keep their path under -output-dir. Needs the aws or gsutil command line tools")
+	flag.StringVar(&csvPath, "report-csv", "", "File to write a CSV report to at the end, one row per command with its id, command, host, attempts, exit code, duration and output directory")
+	flag.StringVar(&htmlPath, "report-html", "", "File to write an HTML report to at the end, a single page with the commands, how busy each host was and links to the output files")
+	flag.StringVar(&junitPath, "report-junit", "", "File to write a JUnit XML report to at the end, with a test case for each command, for CI servers to show")
+	flag.IntVar(&digestLines, "digest-lines", 10, "Log the last N lines of stderr of every command that failed at the end of the run (0 to not log any)")
+	flag.BoolVar(&tee, "tee", false, "Also copy the output of commands to our own stdout and stderr as is, which suits small interactive runs")
+	flag.StringVar(&syslogAddr, "syslog", "", "Also log to syslog: \"local\" for this machine's daemon, or [udp://|tcp://]host:port for a remote one")
+	flag.StringVar(&syslogTag, "syslog-tag", "disgo", "Tag of the messages logged to -syslog")
+	flag.BoolVar(&quiet, "q", false, "Only log what went wrong: commands that failed for good and errors")
+	flag.BoolVar(&verbose, "v", false, "Also log every attempt of every command")
+	flag.BoolVar(&veryVerbose, "vv", false, "Also log how commands reach hosts: the command lines run, connections and sessions")
+	flag.IntVar(&canary, "canary", 0, "Run the first N commands on a single host first, and only start the rest if they all succeed (0 to start everything at once)")
 	flag.Parse()
-
-	rand.Seed(time.Now().UnixNano())
+	switch {
+	case quiet && (verbose || veryVerbose):
+		panic(fmt.Errorf("-q doesn't go with -v or -vv"))
+	case quiet:
+		logLevel = levelError
+	case veryVerbose:
+		logLevel = levelTrace
+	case verbose:
+		logLevel = levelDetail
+	}
+	if syslogAddr != "" {
+		if err := openSyslog(syslogAddr, syslogTag); err != nil {
+			panic(err)
+		}
+	}
+	if tee && stream {
+		panic(fmt.Errorf("-tee doesn't go with -stream, which prefixes the lines it copies"))
+	}
 
 	if len(os.Args) > 1 && os.Args[1] == "help" {
 		flag.Usage()
 		return
 	}
+	if flag.Arg(0) == "tail" {
+		if err := runTail(flag.Args()[1:]); err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	logInfo("SEED=%v", seed)
+
+	for _, opt := range sshOpts {
+		if err := checkSSHOption(opt); err != nil {
+			panic(err)
+		}
+		if transport != "exec" {
+			panic(fmt.Errorf("-ssh-opt needs -transport exec"))
+		}
+	}
+	if envFile != "" {
+		env, err := parseEnvFile(envFile)
+		if err != nil {
+			panic(err)
+		}
+		commandEnv = append(commandEnv, env...)
+	}
+	for _, kv := range envVars {
+		if err := checkEnv(kv); err != nil {
+			panic(err)
+		}
+		commandEnv = append(commandEnv, kv)
+	}
+	// Before the options below so they can be overridden
+	sshOptions = append(sshOptions, sshOpts...)
+	var err error
+	sshPassword, err = loadPassword("SSH", passwordFile, askPassword, passwordEnv)
+	if err != nil {
+		panic(err)
+	}
+	if sshPassword != "" {
+		sshOptions = append(sshOptions, "NumberOfPasswordPrompts=1")
+	}
+	if becomeRoot {
+		becomeUser = becomeAs
+		becomePassword, err = loadPassword("sudo", becomePwFile, askBecomePw, becomePasswordEnv)
+		if err != nil {
+			panic(err)
+		}
+	} else if becomePwFile != "" || askBecomePw {
+		panic(fmt.Errorf("-become-password-file and -become-password-prompt need -become"))
+	}
+	if compression {
+		// The built in client doesn't implement it
+		if transport != "exec" {
+			panic(fmt.Errorf("-compression needs -transport exec"))
+		}
+		sshOptions = append(sshOptions, "Compression=yes")
+	}
+	var cipherList []string
+	if ciphers != "" {
+		cipherList = strings.Split(ciphers, ",")
+		sshOptions = append(sshOptions, "Ciphers="+ciphers)
+	}
+	if gssapi {
+		// The built in client has no Kerberos library to take tickets from
+		if transport != "exec" {
+			panic(fmt.Errorf("-gssapi needs -transport exec"))
+		}
+		sshOptions = append(sshOptions, "GSSAPIAuthentication=yes")
+		if gssDelegate {
+			sshOptions = append(sshOptions, "GSSAPIDelegateCredentials=yes")
+		}
+	} else if gssDelegate {
+		panic(fmt.Errorf("-gssapi-delegate needs -gssapi"))
+	}
+	hostKeyChecking, err := sshclient.ParseHostKeyChecking(hostKeys)
+	if err != nil {
+		panic(err)
+	}
+	switch hostKeyChecking {
+	case sshclient.Strict:
+		sshOptions = append(sshOptions, "StrictHostKeyChecking=yes")
+	case sshclient.AcceptNew:
+		sshOptions = append(sshOptions, "StrictHostKeyChecking=accept-new")
+	case sshclient.Off:
+		sshOptions = append(sshOptions, "StrictHostKeyChecking=no", "UserKnownHostsFile=/dev/null")
+	}
+	switch transport {
+	case "exec":
+		if reuseConns {
+			dir, err := os.MkdirTemp("", "disgo-ssh-")
+			if err != nil {
+				panic(err)
+			}
+			defer func() {
+				closeMasters()
+				os.RemoveAll(dir)
+			}()
+			controlDir = dir
+		}
+	case "native":
+		me, err := user.Current()
+		if err != nil {
+			panic(err)
+		}
+		cfg := sshclient.Config{User: me.Username, ConnectTimeout: 2 * time.Second, Reuse: reuseConns, HostKeys: hostKeyChecking, Password: sshPassword, Env: commandEnv, Ciphers: cipherList}
+		if tracing() {
+			cfg.Trace = func(format string, args ...interface{}) {
+				logTrace("NATIVE %v", fmt.Sprintf(format, args...))
+			}
+		}
+		nativeSSH, err = sshclient.New(cfg)
+		if err != nil {
+			panic(err)
+		}
+		defer nativeSSH.Close()
+	default:
+		panic(fmt.Errorf("unknown -transport %q, expected exec or native", transport))
+	}
 
 	// Load commands and hosts, run all the items until completion
-	commands, err := readLines(cmdsFilePath)
+	if len(cmdsFilePaths) == 0 {
+		cmdsFilePaths = stringList{"cmds.txt"}
+	}
+	var sweep []sweepParam
+	for _, s := range sweepArgs {
+		p, err := parseSweep(s)
+		if err != nil {
+			panic(err)
+		}
+		sweep = append(sweep, p)
+	}
+	var commands []*job
+	var watches []*commandsWatch
+	queues := make(map[string]queueLimit)
+	fromStdin := false
+	for _, path := range cmdsFilePaths {
+		if path == "-" {
+			if fromStdin || hostsFilePath == "-" {
+				panic(fmt.Errorf("only one of -cmds and -hosts can be read from stdin, once"))
+			}
+			fromStdin = true
+		}
+		if structuredCommands(path) {
+			jobs, err := parseCommandFile(path, len(commands), sweep)
+			if err != nil {
+				panic(err)
+			}
+			commands = append(commands, jobs...)
+			continue
+		}
+		var cmdLines []string
+		var err error
+		if watch && path != "-" {
+			w := &commandsWatch{path: path}
+			cmdLines, err = w.read()
+			watches = append(watches, w)
+		} else {
+			cmdLines, err = readLines(path)
+		}
+		if err != nil {
+			panic(err)
+		}
+		name := path
+		if path == "-" {
+			name = "stdin"
+		}
+		jobs, err := parseCommands(name, cmdLines, len(commands), queues, sweep)
+		if err != nil {
+			panic(err)
+		}
+		commands = append(commands, jobs...)
+	}
+	if watch && len(watches) == 0 {
+		panic(fmt.Errorf("-watch needs a plain commands file to watch"))
+	}
+	nextID := len(commands)
+	if scripts {
+		for _, j := range commands {
+			if err := loadScript(j); err != nil {
+				panic(err)
+			}
+		}
+	}
+	labels := make(map[string]int)
+	for _, j := range commands {
+		if other, ok := labels[pathSafe(j.label)]; ok && j.label != "" {
+			panic(fmt.Errorf("commands %v and %v have the same label %q", other, j.id, j.label))
+		}
+		labels[pathSafe(j.label)] = j.id
+	}
+	var jl *journal
+	var resumed []*job
+	if journalPath != "" {
+		var last map[int]journalEntry
+		var err error
+		jl, last, err = openJournal(journalPath, resume)
+		if err != nil {
+			panic(err)
+		}
+		var left []*job
+		for _, j := range commands {
+			e, ok := last[j.id]
+			switch {
+			case !ok:
+				left = append(left, j)
+			case e.Line != j.line:
+				logError("WARNING id=%v changed since the journal was written, running it again", j.id)
+				left = append(left, j)
+			case e.State == stateSucceeded:
+				resumed = append(resumed, j)
+			default:
+				// Keep numbering attempts where the last run left off
+				j.attempts = e.Attempt + 1
+				left = append(left, j)
+			}
+		}
+		if len(resumed) > 0 {
+			logInfo("RESUME %v commands already succeeded, %v left to run", len(resumed), len(left))
+		}
+		commands = left
+	} else if resume {
+		panic(fmt.Errorf("-resume needs a -journal"))
+	}
+	gangSizes := make(map[string]int)
+	for _, j := range commands {
+		if _, ok := queues[j.queue]; j.queue != "" && !ok {
+			panic(fmt.Errorf("%v: command %v uses queue %q, which no %%queue line declares", j.file, j.id, j.queue))
+		}
+		if j.gang != "" {
+			gangSizes[j.gang]++
+		}
+		if err := checkBecomePTY(j, pty); err != nil {
+			panic(fmt.Errorf("%v: %v", j.file, err))
+		}
+	}
+
+	hostLines := []string{localHost}
+	if !local {
+		hostLines, err = readLines(hostsFilePath)
+		if err != nil {
+			panic(err)
+		}
+	}
+	hosts, err := parseHosts(hostsFilePath, hostLines)
+	if err != nil {
+		panic(err)
+	}
+	if jumpHosts != "" {
+		if _, err := parseJump(jumpHosts); err != nil {
+			panic(err)
+		}
+	}
+	loginDefaults(hosts, sshUser, sshPort, sshKey, jumpHosts)
+	for _, h := range hosts {
+		if h.winrm != "" && becomeUser != "" {
+			panic(fmt.Errorf("host %v is a Windows host, which -become can't sudo on", h.name))
+		}
+		if h.winrm != "" && scripts {
+			panic(fmt.Errorf("host %v is a Windows host, which -scripts can't run scripts on", h.name))
+		}
+		if h.winrm != "" && (h.user == "" || sshPassword == "") {
+			panic(fmt.Errorf("host %v needs a user and a password, e.g. from -ssh-password-file, to log in with WinRM", h.name))
+		}
+		if h.winrm == "http" && !winrmHTTP {
+			panic(fmt.Errorf("host %v would be sent the password in the clear over HTTP; use winrms:// or -winrm-insecure", h.name))
+		}
+	}
+	if err := checkPods(hosts); err != nil {
+		panic(err)
+	}
+	for _, h := range hosts {
+		if _, ok := executorFor(h).(localExecutor); ok && anyPTY(commands, pty) {
+			// Better to say so now than to fail every command
+			if err := checkScript(); err != nil {
+				panic(err)
+			}
+			break
+		}
+	}
+	for _, h := range hosts {
+		if nativeSSH != nil && len(h.sshOpts) > 0 {
+			panic(fmt.Errorf("host %v has ssh-opt=, which needs -transport exec", h.name))
+		}
+	}
+	for _, h := range hosts {
+		if nativeSSH != nil && h.key == "" && h.name != localHost && h.image == "" && h.pod == "" && h.winrm == "" {
+			// Better to say so now than to fail on every host
+			if err := nativeSSH.Credentials(); err != nil {
+				panic(err)
+			}
+			break
+		}
+	}
+	var patterns []string
+	for _, value := range exclude {
+		patterns = append(patterns, strings.Split(value, ",")...)
+	}
+	hosts, err = excludeHosts(hosts, patterns)
 	if err != nil {
 		panic(err)
 	}
+	if warmUpHosts && warmUp(hosts, warmUpTimeout) == 0 {
+		panic(fmt.Errorf("none of the hosts in %v could be reached", hostsFilePath))
+	}
+	if healthCheck {
+		hosts = healthyHosts(hosts, healthCmd, healthTimeout)
+		if len(hosts) == 0 {
+			panic(fmt.Errorf("no healthy hosts left in %v", hostsFilePath))
+		}
+	}
 
-	hosts, err := readLines(hostsFilePath)
+	// Feed the commands through a fixed pool of workers so that large command
+	// files don't turn into one ssh session per line all at once.
+	if parallel < 1 {
+		parallel = 1
+	}
+	// Every member of a gang needs its own worker and host at the same time,
+	// and members hold their worker while they wait for the rest. Unless a
+	// worker is left over once every gang but its last member has arrived,
+	// the gangs can end up waiting on each other forever.
+	waiting := 0
+	for name, size := range gangSizes {
+		if size > len(hosts) || size > parallel {
+			panic(fmt.Errorf("gang %q has %v commands, which can't start together on %v hosts with -parallel %v", name, size, len(hosts), parallel))
+		}
+		waiting += size - 1
+	}
+	if waiting >= parallel {
+		panic(fmt.Errorf("%v gangs can keep %v workers waiting for their last member, which needs -parallel %v or more", len(gangSizes), waiting, waiting+1))
+	}
+	pool, err := newHostPool(hosts, hostPoolOptions{
+		mode:        schedule,
+		maxPerHost:  maxPerHost,
+		steal:       steal,
+		seed:        seed,
+		adaptive:    adaptive,
+		adaptMax:    parallel,
+		queues:      queues,
+		backfill:    backfill,
+		preempt:     preempt,
+		gangSizes:   gangSizes,
+		avoidFlaky:  avoidFlaky,
+		maxFailures: maxHostFails,
+	})
 	if err != nil {
 		panic(err)
 	}
+	if circuitFails > 0 {
+		pool.breaker = newBreaker(circuitFails, circuitCool, pool.wake)
+	}
+	if quarantineN > 0 {
+		pool.dead = newQuarantine(quarantineN, reprobeEvery, pool.wake)
+	}
+	if maxLoad > 0 {
+		pool.load = newLoadProber(maxLoad, loadInterval, pool.wake)
+		pool.load.start(hosts)
+	}
 
-	// Try each command one at a time
-	doneChan := make(chan bool)
-	for i, cmd := range commands {
-		go dispatch(i, cmd, hosts, doneChan)
+	// Canaries go first, in file order. Gang members can't run on their own.
+	var canaries, rest []*job
+	for _, j := range commands {
+		if len(canaries) < canary && j.gang == "" {
+			canaries = append(canaries, j)
+		} else {
+			rest = append(rest, j)
+		}
 	}
+	commands = rest
 
-	// Wait for all to report in
-	numCommands := len(commands)
+	// With a deadline, start long commands first (LPT) so that they don't end
+	// up as stragglers at the end of the run.
+	start := time.Now()
+	if deadline > 0 {
+		longestFirst(commands)
+		slots := pool.capacity()
+		if slots == 0 || slots > parallel {
+			slots = parallel
+		}
+		durations := make([]time.Duration, len(commands))
+		for i, j := range commands {
+			durations[i] = j.duration
+		}
+		estimate := scheduler.EstimateMakespan(durations, slots)
+		logInfo("ESTIMATE makespan=%v deadline=%v slots=%v", estimate, deadline, slots)
+		if estimate > deadline {
+			logError("WARNING estimated makespan %v exceeds the deadline of %v", estimate, deadline)
+		}
+	}
+
+	if runID == "" {
+		runID = start.Format("20060102-150405")
+	}
+	output, err := newOutputTree(outputDir, runID)
+	if err != nil {
+		panic(fmt.Errorf("could not create the output directory: %v", err))
+	}
+	output.combined, output.compress, output.timestamps, output.stripANSI = combinedOut, compressLogs, timestamps, stripANSI
+	if maxOutput != "" {
+		if output.maxSize, err = parseSize(maxOutput); err != nil {
+			panic(fmt.Errorf("bad -max-output-size: %v", err))
+		}
+		if output.maxSize < 2 {
+			// Half of it is kept from the end, which can't be nothing
+			panic(fmt.Errorf("bad -max-output-size: must be at least 2 bytes, got %q", maxOutput))
+		}
+	}
+	logInfo("OUTPUT dir=%v", output.dir)
+	if err := output.writeRunMeta(&runMeta{Started: start, Commands: nextID, Watch: watch}); err != nil {
+		panic(fmt.Errorf("could not write the metadata of the run: %v", err))
+	}
+	var merged io.Writer
+	if mergedPath != "" {
+		if !filepath.IsAbs(mergedPath) {
+			mergedPath = filepath.Join(output.dir, mergedPath)
+		}
+		f, err := os.OpenFile(mergedPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			panic(fmt.Errorf("could not open the merged log: %v", err))
+		}
+		defer f.Close()
+		merged = f
+	}
+	var hostLog *hostLogs
+	if hostLogsOn {
+		if hostLog, err = newHostLogs(filepath.Join(output.dir, "hosts")); err != nil {
+			panic(fmt.Errorf("could not create the directory of the host logs: %v", err))
+		}
+	}
+	var uploads *uploader
+	if uploadDest != "" {
+		if uploads, err = newUploader(uploadDest, outputDir); err != nil {
+			panic(err)
+		}
+	}
+	var events *eventLog
+	if eventsPath != "" {
+		if !filepath.IsAbs(eventsPath) {
+			eventsPath = filepath.Join(output.dir, eventsPath)
+		}
+		if events, err = openEventLog(eventsPath); err != nil {
+			panic(fmt.Errorf("could not open the event log: %v", err))
+		}
+	}
+
+	d := &dispatcher{
+		pool:     pool,
+		budget:   newAttemptBudget(maxAttempts),
+		retries:  retries,
+		backoff:  backoff,
+		sameHost: sameHost,
+		perHost:  perHostCap,
+		results:  make(chan *result),
+		// Preempted commands need to be stopped on the remote side
+		stoppable:       preempt,
+		timeout:         timeout,
+		stall:           stallTimeout,
+		chdir:           chdir,
+		output:          output,
+		pty:             pty,
+		stream:          stream,
+		tee:             tee,
+		template:        outputTemplate(outputPath),
+		merged:          merged,
+		uploads:         uploads,
+		hostLogs:        hostLog,
+		safeQuoting:     quoting == "safe",
+		onFailure:       onFailure,
+		journal:         jl,
+		events:          events,
+		failedLogs:      failedLogs,
+		keepAttempts:    keepAttempts,
+		archiveAttempts: archiveOld,
+		causes:          newCauseCounts(),
+	}
+	if err := checkFailedLogs(failedLogs); err != nil {
+		panic(err)
+	}
+	if quoting != "raw" && quoting != "safe" {
+		panic(fmt.Errorf("unknown -quote %q, expected raw or safe", quoting))
+	}
+	if err := d.template.check(combinedOut); err != nil {
+		panic(err)
+	}
+	if backoff.Jitter < 0 || backoff.Jitter > 1 {
+		panic(fmt.Errorf("-backoff-jitter must be between 0 and 1, got %v", backoff.Jitter))
+	}
+	if retryOnExit != "" {
+		d.retryCodes = make(map[int]bool)
+		for _, field := range strings.Split(retryOnExit, ",") {
+			code, err := strconv.Atoi(strings.TrimSpace(field))
+			if err != nil {
+				panic(fmt.Errorf("bad -retry-on-exit status %q", field))
+			}
+			d.retryCodes[code] = true
+		}
+	}
+	if dispatchRate > 0 {
+		d.limiter = scheduler.NewTokenBucket(dispatchRate, 1)
+	}
+
+	// The latest result of every job, a requeued job's replaces the earlier one
+	final := make(map[*job]*result)
+	for _, j := range resumed {
+		final[j] = &result{job: j, ok: true}
+	}
+	var giveUp <-chan time.Time
+	if runDeadline > 0 {
+		time.AfterFunc(runDeadline, func() {
+			logInfo("RUN DEADLINE of %v reached, not starting anything new", runDeadline)
+			pool.shutdown()
+		})
+		giveUp = time.After(runDeadline + runGrace)
+	}
+	// runPass dispatches jobs and waits for all of them to report in. It
+	// returns false if the run deadline grace period ran out first. Jobs
+	// that come in on more are dispatched as well, until it is closed.
+	runPass := func(jobs []*job, more <-chan []*job) bool {
+		// Queue everything up front so the most important commands are
+		// handed out first as workers free up.
+		queue := scheduler.NewQueue(0)
+		for _, j := range jobs {
+			queue.PushFrom(j.file, j, j.priority)
+		}
+		if more == nil {
+			queue.Close()
+		}
+		for w := 0; w < parallel; w++ {
+			go d.worker(queue)
+		}
+		for left := len(jobs); left > 0 || more != nil; {
+			select {
+			case r := <-d.results:
+				final[r.job] = r
+				left--
+			case added, ok := <-more:
+				if !ok {
+					more = nil
+					queue.Close()
+					continue
+				}
+				for _, j := range added {
+					queue.PushFrom(j.file, j, j.priority)
+				}
+				commands = append(commands, added...)
+				left += len(added)
+			case <-giveUp:
+				return false
+			}
+		}
+		return true
+	}
+	healthy := true
+	if len(canaries) > 0 {
+		var results []*result
+		results, healthy = d.runCanaries(canaries)
+		for _, r := range results {
+			final[r.job] = r
+		}
+		if !healthy {
+			logError("CANARY failed, not starting the remaining %v commands", len(commands))
+		}
+	}
+	var more <-chan []*job
+	if watch && healthy {
+		more = watchCommands(watches, func(path string, firstLine int, lines []string) []*job {
+			var jobs []*job
+			for i, line := range lines {
+				if strings.HasPrefix(line, "%") {
+					logError("ERROR %v line %v: directives added while watching are ignored", path, firstLine+i)
+					continue
+				}
+				js, err := parseCommandsAt(path, firstLine+i, []string{line}, nextID, queues, sweep)
+				if err != nil {
+					logError("ERROR %v", err)
+					continue
+				}
+				// Ids of the jobs left out aren't given out again
+				nextID += len(js)
+				for _, j := range js {
+					if _, ok := queues[j.queue]; j.queue != "" && !ok {
+						logError("ERROR %v line %v: queue %q isn't declared", path, firstLine+i, j.queue)
+						continue
+					}
+					if j.gang != "" {
+						logError("ERROR %v line %v: gangs can't be added while watching", path, firstLine+i)
+						continue
+					}
+					if err := checkBecomePTY(j, pty); err != nil {
+						logError("ERROR %v line %v: %v", path, firstLine+i, err)
+						continue
+					}
+					if other, ok := labels[pathSafe(j.label)]; ok && j.label != "" {
+						logError("ERROR %v line %v: command %v has the same label %q", path, firstLine+i, other, j.label)
+						continue
+					}
+					if scripts {
+						if err := loadScript(j); err != nil {
+							logError("ERROR %v line %v: %v", path, firstLine+i, err)
+							continue
+						}
+					}
+					labels[pathSafe(j.label)] = j.id
+					logInfo("WATCH id=%v added from %v", j.id, path)
+					jobs = append(jobs, j)
+				}
+			}
+			return jobs
+		}, watchStop(), pool.isShutdown)
+	}
+	if healthy && runPass(commands, more) {
+		// Give commands that failed for no reason of their own another go,
+		// the cluster may have recovered in the meantime
+		for pass := 1; pass <= requeuePasses; pass++ {
+			var again []*job
+			for _, j := range commands {
+				if r := final[j]; !r.ok && !r.permanent && !r.failedFast && !r.undone {
+					again = append(again, j)
+				}
+			}
+			if len(again) == 0 || pool.isShutdown() {
+				break
+			}
+			logInfo("REQUEUE pass=%v commands=%v", pass, len(again))
+			if !runPass(again, nil) {
+				break
+			}
+		}
+	}
+
+	all := append(append(canaries, commands...), resumed...)
+	sort.Slice(all, func(i, k int) bool {
+		return all[i].id < all[k].id
+	})
 	numSuccessful := 0
-	for left := 0; left < numCommands; left++ {
-		if <-doneChan {
+	var failed []*job
+	var failedFast, permanent, undone, abandoned []string
+	finalCauses := newCauseCounts()
+	for _, j := range all {
+		r := final[j]
+		switch {
+		case r == nil:
+			if healthy {
+				abandoned = append(abandoned, fmt.Sprint(j.id))
+			}
+		case r.ok:
 			numSuccessful++
+			continue
+		case r.failedFast:
+			failedFast = append(failedFast, fmt.Sprint(j.id))
+		case r.permanent:
+			permanent = append(permanent, fmt.Sprint(j.id))
+		case r.undone:
+			undone = append(undone, fmt.Sprint(j.id))
+		}
+		if r != nil && r.cause != "" {
+			finalCauses.add(r.cause)
+		}
+		failed = append(failed, j)
+	}
+	pool.report()
+	logInfo("FINISHED=%v FAILED=%v TOTAL=%v", numSuccessful, len(all)-numSuccessful, len(all))
+	if n := d.causes.total(); n > 0 {
+		logInfo("CAUSES of %v failed attempts: %v", n, d.causes)
+	}
+	if n := finalCauses.total(); n > 0 {
+		logInfo("CAUSES of %v failed commands: %v", n, finalCauses)
+	}
+	if len(failedFast) > 0 {
+		logInfo("FAILFAST=%v attempt budget ran out before ids=%v could complete", len(failedFast), strings.Join(failedFast, ","))
+	}
+	if len(permanent) > 0 {
+		logInfo("PERMANENT=%v ids=%v exited with a status -retry-on-exit doesn't retry", len(permanent), strings.Join(permanent, ","))
+	}
+	if failedPath != "" {
+		if err := writeFailed(failedPath, failed, queues, cmdsFilePaths); err != nil {
+			logError("ERROR could not write failed commands to %v: %v", failedPath, err)
+		}
+	}
+	if len(undone) > 0 {
+		logError("UNDONE=%v ids=%v were not run before the run deadline", len(undone), strings.Join(undone, ","))
+	}
+	if len(abandoned) > 0 {
+		logError("ABANDONED=%v ids=%v were still running after the run deadline grace period", len(abandoned), strings.Join(abandoned, ","))
+	}
+	if deadline > 0 {
+		elapsed := time.Since(start)
+		if elapsed > deadline {
+			logError("DEADLINE missed by %v (elapsed=%v deadline=%v)", elapsed-deadline, elapsed, deadline)
+		} else {
+			logInfo("DEADLINE met with %v to spare (elapsed=%v deadline=%v)", deadline-elapsed, elapsed, deadline)
+		}
+	}
+	summary := summarize(output, all, final, pool.scoresByName(), healthy, start)
+	logDigest(output, summary, digestLines)
+	summaryPath := filepath.Join(output.dir, "summary.json")
+	if err := summary.write(summaryPath); err != nil {
+		logError("ERROR could not write the summary of the run: %v", err)
+	}
+	if htmlPath != "" {
+		if err := summary.writeHTML(htmlPath); err != nil {
+			logError("ERROR could not write the HTML report to %v: %v", htmlPath, err)
+		}
+	}
+	if junitPath != "" {
+		if err := summary.writeJUnit(junitPath); err != nil {
+			logError("ERROR could not write the JUnit report to %v: %v", junitPath, err)
+		}
+	}
+	if csvPath != "" {
+		if err := summary.writeCSV(csvPath); err != nil {
+			logError("ERROR could not write the CSV report to %v: %v", csvPath, err)
+		}
+	}
+	for _, path := range append([]string{eventsPath, mergedPath, summaryPath}, hostLog.close()...) {
+		if path != "" {
+			uploads.upload(path)
+		}
+	}
+	for _, path := range []string{htmlPath, junitPath, csvPath} {
+		if path == "" {
+			continue
+		}
+		// Reports written outside the output directory go with the run
+		as := path
+		if rel, err := filepath.Rel(outputDir, path); err != nil || strings.HasPrefix(rel, "..") {
+			as = filepath.Join(output.dir, filepath.Base(path))
 		}
+		uploads.uploadAs(path, as)
 	}
-	debug("FINISHED=%v FAILED=%v TOTAL=%v", numSuccessful, numCommands-numSuccessful, numCommands)
+	uploads.wait()
 }
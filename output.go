@@ -0,0 +1,733 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// An outputTree lays out the output of a run in its own directory:
+//
+//	<run-id>/<cmd-id>/attempt-<n>/stdout     what the attempt printed
+//	<run-id>/<cmd-id>/attempt-<n>/stderr     and its errors
+//	<run-id>/<cmd-id>/attempt-<n>/meta.json  how it went
+//	<run-id>/<cmd-id>/meta.json              how every attempt went
+//	<run-id>/<cmd-id>/final                  link to the attempt that succeeded
+//	<run-id>/by-label/<label>                link to the command with that label
+//	<run-id>/run.json                        what the run is running
+//
+// With combined set, stdout and stderr go interleaved to a single file named
+// output instead. With compress set, output files are gzipped and named
+// with a .gz suffix. With timestamps set, every line of output starts with
+// the time it was printed. With maxSize set, output files that would grow
+// past it keep only their start and end, each half of maxSize. With
+// stripANSI set, escape sequences for colors and the like are left out.
+type outputTree struct {
+	dir        string
+	combined   bool
+	compress   bool
+	timestamps bool
+	maxSize    int64
+	stripANSI  bool
+}
+
+// newOutputTree creates the directory for run id under dir.
+func newOutputTree(dir, id string) (outputTree, error) {
+	t := outputTree{dir: filepath.Join(dir, id)}
+	return t, os.MkdirAll(t.dir, 0755)
+}
+
+// commandDir returns the directory of command id.
+func (t outputTree) commandDir(id int) string {
+	return filepath.Join(t.dir, strconv.Itoa(id))
+}
+
+// attemptDir returns the directory of attempt number attempt of command id.
+func (t outputTree) attemptDir(id, attempt int) string {
+	return filepath.Join(t.dir, strconv.Itoa(id), fmt.Sprintf("attempt-%v", attempt))
+}
+
+// An outputFile is a file the output of an attempt goes to, gzipped as it is
+// written if compression is on. More than one goroutine can write to it.
+type outputFile struct {
+	mu   sync.Mutex
+	f    *os.File
+	zw   *gzip.Writer // nil if uncompressed
+	w    io.Writer    // f or zw
+	name string       // in the attempt's directory
+	// With a limit, the first half of it is written as it comes and the
+	// last half kept in tail, a file next to this one, until it is closed
+	limit int64
+	head  int64 // bytes written so far
+	tail  *ring
+}
+
+func (t outputTree) createOutputFile(dir, name string) (*outputFile, error) {
+	if t.compress {
+		name += ".gz"
+	}
+	f, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		return nil, err
+	}
+	o := &outputFile{f: f, w: f, name: name, limit: t.maxSize}
+	if t.compress {
+		o.zw = gzip.NewWriter(f)
+		o.w = o.zw
+	}
+	return o, nil
+}
+
+func (o *outputFile) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.limit <= 0 {
+		return o.w.Write(p)
+	}
+	n := len(p)
+	if room := o.limit - o.limit/2 - o.head; room > 0 {
+		k := min(int64(len(p)), room)
+		if _, err := o.w.Write(p[:k]); err != nil {
+			return 0, err
+		}
+		o.head += k
+		p = p[k:]
+	}
+	if len(p) > 0 {
+		if o.tail == nil {
+			f, err := os.CreateTemp(filepath.Dir(o.f.Name()), "."+o.name+".tail-*")
+			if err != nil {
+				return 0, err
+			}
+			o.tail = &ring{f: f, size: o.limit / 2}
+		}
+		if _, err := o.tail.Write(p); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// truncated returns how many bytes of output were left out of the file.
+func (o *outputFile) truncated() int64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.tail == nil {
+		return 0
+	}
+	return o.tail.dropped()
+}
+
+func (o *outputFile) close() error {
+	if o.tail != nil {
+		if dropped := o.tail.dropped(); dropped > 0 {
+			fmt.Fprintf(o.w, "\n[disgo: %v bytes of output left out]\n", dropped)
+		}
+		err := o.tail.writeTo(o.w)
+		if cerr := o.tail.close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			o.f.Close()
+			return err
+		}
+	}
+	if o.zw != nil {
+		if err := o.zw.Close(); err != nil {
+			o.f.Close()
+			return err
+		}
+	}
+	return o.f.Close()
+}
+
+// A ring keeps the last size bytes written to it in f, so that a large
+// -max-output-size doesn't cost as much memory for every attempt running.
+type ring struct {
+	f     *os.File
+	size  int64
+	total int64 // bytes ever written
+}
+
+func (r *ring) Write(p []byte) (int, error) {
+	n := len(p)
+	if int64(len(p)) > r.size {
+		// Only the end of p will be kept
+		r.total += int64(len(p)) - r.size
+		p = p[int64(len(p))-r.size:]
+	}
+	for len(p) > 0 {
+		off := r.total % r.size
+		k := min(int64(len(p)), r.size-off)
+		if _, err := r.f.WriteAt(p[:k], off); err != nil {
+			return 0, err
+		}
+		r.total += k
+		p = p[k:]
+	}
+	return n, nil
+}
+
+// dropped returns how many bytes were written that the ring no longer has.
+func (r *ring) dropped() int64 {
+	return max(r.total-r.size, 0)
+}
+
+// writeTo writes what the ring has to w, oldest first.
+func (r *ring) writeTo(w io.Writer) error {
+	var err error
+	if r.total <= r.size {
+		_, err = io.Copy(w, io.NewSectionReader(r.f, 0, r.total))
+	} else {
+		i := r.total % r.size
+		_, err = io.Copy(w, io.MultiReader(io.NewSectionReader(r.f, i, r.size-i), io.NewSectionReader(r.f, 0, i)))
+	}
+	return err
+}
+
+// close removes the ring's file.
+func (r *ring) close() error {
+	err := r.f.Close()
+	if rerr := os.Remove(r.f.Name()); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// A countingWriter passes writes on to w, counting the bytes and hashing
+// them as they were written, before w changes them in any way.
+type countingWriter struct {
+	w   io.Writer
+	n   atomic.Int64
+	mu  sync.Mutex
+	sum hash.Hash // SHA-256
+}
+
+func newCountingWriter(w io.Writer) *countingWriter {
+	return &countingWriter{w: w, sum: sha256.New()}
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n.Add(int64(n))
+	c.mu.Lock()
+	c.sum.Write(p[:n])
+	c.mu.Unlock()
+	return n, err
+}
+
+// checksum returns the SHA-256 of what was written to c, in hex.
+func (c *countingWriter) checksum() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return hex.EncodeToString(c.sum.Sum(nil))
+}
+
+// Layout of the timestamps lines of output start with if -timestamps is on
+const timestampLayout = "2006-01-02T15:04:05.000000Z07:00"
+
+// A timestampWriter passes writes on to w with the time each line started
+// coming in put in front of it.
+type timestampWriter struct {
+	w         io.Writer
+	lineStart bool // whether the next byte starts a line
+}
+
+func (t *timestampWriter) Write(p []byte) (int, error) {
+	var out []byte
+	for _, line := range bytes.SplitAfter(p, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		if t.lineStart {
+			out = append(time.Now().AppendFormat(out, timestampLayout), ' ')
+		}
+		out = append(out, line...)
+		t.lineStart = line[len(line)-1] == '\n'
+	}
+	if _, err := t.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// attemptOutput holds the files the output of an attempt goes to. With the
+// output combined, stdout and stderr go to the same file.
+type attemptOutput struct {
+	stdout, stderr         *countingWriter
+	stdoutFile, stderrFile *outputFile
+}
+
+// files returns the distinct files of o.
+func (o *attemptOutput) files() []*outputFile {
+	if o.stderrFile == o.stdoutFile {
+		return []*outputFile{o.stdoutFile}
+	}
+	return []*outputFile{o.stdoutFile, o.stderrFile}
+}
+
+// close closes the files, returning the first error, which for compressed
+// files can mean output was lost.
+func (o *attemptOutput) close() error {
+	var firstErr error
+	for _, f := range o.files() {
+		if err := f.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// record notes the names of the closed output files in m, and how much went
+// to each stream and its checksum.
+func (o *attemptOutput) record(m *attemptMeta) {
+	m.Stdout, m.StdoutBytes = o.stdoutFile.name, o.stdout.n.Load()
+	m.Stderr, m.StderrBytes = o.stderrFile.name, o.stderr.n.Load()
+	m.StdoutSHA256, m.StderrSHA256 = o.stdout.checksum(), o.stderr.checksum()
+	m.Truncated = 0
+	for _, f := range o.files() {
+		m.Truncated += f.truncated()
+	}
+}
+
+// dispose applies the -failed-logs policy to the closed output files of a
+// failed attempt, updating their names in m.
+func (o *attemptOutput) dispose(policy string, m *attemptMeta) error {
+	var firstErr error
+	names := make(map[*outputFile]string)
+	for _, f := range o.files() {
+		path, err := disposeFailedLog(f.f.Name(), policy)
+		if path != "" {
+			path = filepath.Base(path)
+		}
+		names[f] = path
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("could not %v %v: %v", policy, f.f.Name(), err)
+		}
+	}
+	m.Stdout, m.Stderr = names[o.stdoutFile], names[o.stderrFile]
+	return firstErr
+}
+
+// createOutput creates the directory of an attempt and the files its output
+// goes to.
+func (t outputTree) createOutput(id, attempt int) (*attemptOutput, error) {
+	dir := t.attemptDir(id, attempt)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	o := &attemptOutput{}
+	if t.combined {
+		f, err := t.createOutputFile(dir, "output")
+		if err != nil {
+			return nil, err
+		}
+		o.stdoutFile, o.stderrFile = f, f
+	} else {
+		stdout, err := t.createOutputFile(dir, "stdout")
+		if err != nil {
+			return nil, err
+		}
+		stderr, err := t.createOutputFile(dir, "stderr")
+		if err != nil {
+			stdout.close()
+			return nil, err
+		}
+		o.stdoutFile, o.stderrFile = stdout, stderr
+	}
+	var stdout, stderr io.Writer = o.stdoutFile, o.stderrFile
+	if t.timestamps {
+		stdout, stderr = &timestampWriter{w: stdout, lineStart: true}, &timestampWriter{w: stderr, lineStart: true}
+	}
+	if t.stripANSI {
+		stdout, stderr = &ansiStripper{w: stdout}, &ansiStripper{w: stderr}
+	}
+	o.stdout, o.stderr = newCountingWriter(stdout), newCountingWriter(stderr)
+	return o, nil
+}
+
+// linkLabel points the by-label link of label at the directory of command
+// id, for commands to be found by their label.
+func (t outputTree) linkLabel(id int, label string) error {
+	dir := filepath.Join(t.dir, "by-label")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	link := filepath.Join(dir, pathSafe(label))
+	tmp := link + ".tmp"
+	os.Remove(tmp)
+	if err := os.Symlink(filepath.Join("..", strconv.Itoa(id)), tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, link)
+}
+
+// markFinal points the final link of command id at the attempt that
+// succeeded, replacing any link left by an earlier run.
+func (t outputTree) markFinal(id, attempt int) error {
+	link := filepath.Join(t.dir, strconv.Itoa(id), "final")
+	tmp := link + ".tmp"
+	os.Remove(tmp)
+	if err := os.Symlink(fmt.Sprintf("attempt-%v", attempt), tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, link)
+}
+
+// attemptMeta is what meta.json records about an attempt.
+type attemptMeta struct {
+	ID       int       `json:"id"`
+	Label    string    `json:"label,omitempty"`
+	Command  string    `json:"command"`
+	Host     string    `json:"host"`
+	Attempt  int       `json:"attempt"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Duration float64   `json:"duration_seconds"`
+	OK       bool      `json:"ok"`
+	Exit     *int      `json:"exit_code,omitempty"` // unset if the command didn't exit by itself
+	Error    string    `json:"error,omitempty"`
+	Cause    string    `json:"cause,omitempty"`
+	// Names of the output files in the attempt's directory, the same one
+	// for both with the output combined and unset once deleted, and how
+	// many bytes of output went to each stream
+	Stdout      string `json:"stdout,omitempty"`
+	StdoutBytes int64  `json:"stdout_bytes"`
+	Stderr      string `json:"stderr,omitempty"`
+	StderrBytes int64  `json:"stderr_bytes"`
+	Truncated   int64  `json:"truncated_bytes,omitempty"` // left out of the files for -max-output-size
+	// SHA-256 of what the command printed to each stream, in hex, before
+	// -timestamps, -strip-ansi or -max-output-size touch it
+	StdoutSHA256 string `json:"stdout_sha256,omitempty"`
+	StderrSHA256 string `json:"stderr_sha256,omitempty"`
+}
+
+// writeMeta writes meta.json for an attempt.
+func (t outputTree) writeMeta(m *attemptMeta) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(t.attemptDir(m.ID, m.Attempt), "meta.json"), append(data, '\n'), 0644)
+}
+
+// commandMeta is what meta.json records about a command.
+type commandMeta struct {
+	ID       int           `json:"id"`
+	Label    string        `json:"label,omitempty"`
+	Command  string        `json:"command"`
+	OK       bool          `json:"ok"`
+	Host     string        `json:"host,omitempty"` // of the last attempt
+	Started  time.Time     `json:"started"`        // of the first attempt
+	Finished time.Time     `json:"finished"`       // of the last attempt
+	Duration float64       `json:"duration_seconds"`
+	Attempts []attemptMeta `json:"attempts"`
+}
+
+// writeCommandMeta writes meta.json for command id from the metadata of its
+// attempts, including those of earlier runs with the same run id. Commands
+// with no attempts get none.
+func (t outputTree) writeCommandMeta(id int, command string, ok bool) error {
+	paths, err := filepath.Glob(filepath.Join(t.dir, strconv.Itoa(id), "attempt-*", "meta.json"))
+	if err != nil || len(paths) == 0 {
+		return err
+	}
+	m := commandMeta{ID: id, Command: command, OK: ok}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var a attemptMeta
+		if err := json.Unmarshal(data, &a); err != nil {
+			return fmt.Errorf("%v: %v", path, err)
+		}
+		m.Attempts = append(m.Attempts, a)
+	}
+	sort.Slice(m.Attempts, func(i, k int) bool { return m.Attempts[i].Attempt < m.Attempts[k].Attempt })
+	first, last := m.Attempts[0], m.Attempts[len(m.Attempts)-1]
+	m.Label, m.Host, m.Started, m.Finished = last.Label, last.Host, first.Started, last.Finished
+	m.Duration = m.Finished.Sub(m.Started).Seconds()
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(t.dir, strconv.Itoa(id), "meta.json"), append(data, '\n'), 0644)
+}
+
+// runMeta is what run.json records about a run, from when it starts.
+type runMeta struct {
+	Started  time.Time `json:"started"`
+	Commands int       `json:"commands"`        // ids go from 0 to one less
+	Watch    bool      `json:"watch,omitempty"` // more can come with -watch
+}
+
+// writeRunMeta writes run.json.
+func (t outputTree) writeRunMeta(m *runMeta) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(t.dir, "run.json"), append(data, '\n'), 0644)
+}
+
+// readRunMeta reads run.json.
+func (t outputTree) readRunMeta() (*runMeta, error) {
+	path := filepath.Join(t.dir, "run.json")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := &runMeta{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return m, nil
+}
+
+// readCommandMeta reads the meta.json of command id.
+func (t outputTree) readCommandMeta(id int) (*commandMeta, error) {
+	path := filepath.Join(t.commandDir(id), "meta.json")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := &commandMeta{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	if len(m.Attempts) == 0 {
+		return nil, fmt.Errorf("%v: no attempts", path)
+	}
+	return m, nil
+}
+
+// cleanAttempts removes the output of the other attempts of command id once
+// attempt succeeded, leaving their meta.json with the output files unset.
+// With archive set, the output is first packed into attempts.tar.gz in the
+// command's directory.
+func (t outputTree) cleanAttempts(id, attempt int, archive bool) error {
+	dir := filepath.Join(t.dir, strconv.Itoa(id))
+	paths, err := filepath.Glob(filepath.Join(dir, "attempt-*", "meta.json"))
+	if err != nil {
+		return err
+	}
+	var metas []*attemptMeta
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		m := &attemptMeta{}
+		if err := json.Unmarshal(data, m); err != nil {
+			return fmt.Errorf("%v: %v", path, err)
+		}
+		if m.Attempt != attempt && (m.Stdout != "" || m.Stderr != "") {
+			metas = append(metas, m)
+		}
+	}
+	if len(metas) == 0 {
+		return nil
+	}
+	if archive {
+		if err := t.archiveAttempts(dir, metas); err != nil {
+			return err
+		}
+	}
+	for _, m := range metas {
+		for _, name := range []string{m.Stdout, m.Stderr} {
+			if name == "" {
+				continue
+			}
+			if err := os.Remove(filepath.Join(t.attemptDir(id, m.Attempt), name)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		m.Stdout, m.Stderr = "", ""
+		if err := t.writeMeta(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// archiveAttempts packs the output files of the attempts metas describe
+// into attempts.tar.gz in dir, as attempt-<n>/<file>.
+func (t outputTree) archiveAttempts(dir string, metas []*attemptMeta) error {
+	f, err := os.Create(filepath.Join(dir, "attempts.tar.gz"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zw := gzip.NewWriter(f)
+	tw := tar.NewWriter(zw)
+	for _, m := range metas {
+		names := []string{m.Stdout}
+		if m.Stderr != m.Stdout {
+			names = append(names, m.Stderr)
+		}
+		for _, name := range names {
+			if name == "" {
+				continue
+			}
+			if err := addToTar(tw, filepath.Join(t.attemptDir(m.ID, m.Attempt), name), fmt.Sprintf("attempt-%v/%v", m.Attempt, name)); err != nil {
+				return err
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// addToTar adds the file at path to tw as name.
+func addToTar(tw *tar.Writer, path, name string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	hdr, err := tar.FileInfoHeader(fi, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, in)
+	return err
+}
+
+// An outputTemplate names where the final output of every command is put as
+// well, e.g. "{dir}/{label}-{host}.log". It can use {dir} for the run's
+// directory, {run} for its id, {id}, {label}, {host} and {attempt} for the
+// command and the attempt that succeeded, and {stream} for stdout, stderr or
+// output. Compressed output gets a .gz suffix on top.
+type outputTemplate string
+
+var placeholder = regexp.MustCompile(`\{[a-z]*\}`)
+
+// check validates t for output that is combined or not. An empty template
+// puts output nowhere else.
+func (t outputTemplate) check(combined bool) error {
+	if t == "" {
+		return nil
+	}
+	for _, p := range placeholder.FindAllString(string(t), -1) {
+		switch p {
+		case "{dir}", "{run}", "{id}", "{label}", "{host}", "{attempt}", "{stream}":
+		default:
+			return fmt.Errorf("unknown placeholder %v in -output %q", p, t)
+		}
+	}
+	if !combined && !strings.Contains(string(t), "{stream}") {
+		return fmt.Errorf("-output %q needs {stream} to tell stdout from stderr, unless -combined-output", t)
+	}
+	return nil
+}
+
+// publish links the output files of the attempt of j on h that succeeded to
+// where the template tmpl says, copying them if they can't be linked.
+func (t outputTree) publish(tmpl outputTemplate, j *job, h *host, attempt int, out *attemptOutput) error {
+	label := j.label
+	if label == "" {
+		label = strconv.Itoa(j.id)
+	}
+	for _, f := range out.files() {
+		stream, compressed := strings.CutSuffix(f.name, ".gz")
+		dst := strings.NewReplacer(
+			"{dir}", t.dir,
+			"{run}", filepath.Base(t.dir),
+			"{id}", strconv.Itoa(j.id),
+			"{label}", pathSafe(label),
+			"{host}", pathSafe(h.name),
+			"{attempt}", strconv.Itoa(attempt),
+			"{stream}", stream,
+		).Replace(string(tmpl))
+		if compressed {
+			dst += ".gz"
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		src := filepath.Join(t.attemptDir(j.id, attempt), f.name)
+		os.Remove(dst)
+		if os.Link(src, dst) == nil {
+			continue
+		}
+		if err := copyFile(src, dst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pathSafe makes s fit in a single path element.
+func pathSafe(s string) string {
+	return strings.ReplaceAll(s, "/", "_")
+}
+
+// copyFile copies the file at src to dst.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// parseSize parses a size in bytes with an optional K, M or G suffix for
+// powers of 1024, e.g. "64K".
+func parseSize(s string) (int64, error) {
+	orig, shift := s, 0
+	switch {
+	case strings.HasSuffix(s, "K"):
+		shift = 10
+	case strings.HasSuffix(s, "M"):
+		shift = 20
+	case strings.HasSuffix(s, "G"):
+		shift = 30
+	}
+	if shift > 0 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 1 || n > math.MaxInt64>>shift {
+		return 0, fmt.Errorf("size must be a positive number of bytes like 64K, got %q", orig)
+	}
+	return n << shift, nil
+}
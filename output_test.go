@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRing(t *testing.T) {
+	tests := []struct {
+		name    string
+		writes  []string
+		want    string
+		dropped int64
+	}{
+		{"nothing written", nil, "", 0},
+		{"less than it holds", []string{"ab", "c"}, "abc", 0},
+		{"exactly what it holds", []string{"abcd"}, "abcd", 0},
+		{"wraps around", []string{"abc", "def"}, "cdef", 2},
+		{"one write past the size", []string{"a", "bcdefgh"}, "efgh", 4},
+		{"many small writes", []string{"a", "b", "c", "d", "e", "f", "g"}, "defg", 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := os.Create(filepath.Join(t.TempDir(), "tail"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := &ring{f: f, size: 4}
+			for _, w := range tt.writes {
+				if n, err := r.Write([]byte(w)); n != len(w) || err != nil {
+					t.Fatalf("Write(%q) = %v, %v", w, n, err)
+				}
+			}
+			var got bytes.Buffer
+			if err := r.writeTo(&got); err != nil {
+				t.Fatal(err)
+			}
+			if got.String() != tt.want {
+				t.Errorf("ring has %q, want %q", got.String(), tt.want)
+			}
+			if d := r.dropped(); d != tt.dropped {
+				t.Errorf("dropped() = %v, want %v", d, tt.dropped)
+			}
+			if err := r.close(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(f.Name()); !os.IsNotExist(err) {
+				t.Errorf("close() left %v behind", f.Name())
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// Environment variable to read the SSH password from. The ssh binary gets it
+// back from disgo itself, run as its SSH_ASKPASS program.
+const passwordEnv = "DISGO_SSH_PASSWORD"
+
+// Set in the environment of disgo when ssh runs it as SSH_ASKPASS
+const askpassEnv = "DISGO_ASKPASS"
+
+// sshPassword, if set, is used to log in to hosts that don't take our keys.
+// It must never be logged.
+var sshPassword string
+
+// loadPassword returns the password for what from the first line of the file
+// at path, from the user at the terminal if prompt is set, or from the
+// environment variable env, in that order. It returns "" if none of them
+// gives one.
+func loadPassword(what, path string, prompt bool, env string) (string, error) {
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		password, _, _ := strings.Cut(string(data), "\n")
+		if password == "" {
+			return "", fmt.Errorf("password file %v is empty", path)
+		}
+		return password, nil
+	}
+	if prompt {
+		tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+		if err != nil {
+			return "", fmt.Errorf("prompting for the %v password: %w", what, err)
+		}
+		defer tty.Close()
+		fmt.Fprintf(tty, "%v password: ", what)
+		password, err := term.ReadPassword(int(tty.Fd()))
+		fmt.Fprintln(tty)
+		if err != nil {
+			return "", fmt.Errorf("prompting for the %v password: %w", what, err)
+		}
+		return string(password), nil
+	}
+	return os.Getenv(env), nil
+}
+
+// askpass is what disgo does when run by ssh as its SSH_ASKPASS program:
+// answer the password prompt from the environment ssh passed down.
+func askpass() {
+	fmt.Println(os.Getenv(passwordEnv))
+}
+
+// passwordEnviron returns the environment to run the ssh binary with so that
+// it asks disgo for sshPassword, or nil if there is no password.
+func passwordEnviron() []string {
+	if sshPassword == "" {
+		return nil
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return nil
+	}
+	return append(os.Environ(),
+		"SSH_ASKPASS="+self,
+		"SSH_ASKPASS_REQUIRE=force",
+		askpassEnv+"=1",
+		passwordEnv+"="+sshPassword,
+	)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Prints the 1 minute load average on Linux, or the uptime line elsewhere
+const loadProbeCommand = "cat /proc/loadavg 2>/dev/null || uptime"
+
+// loadProber keeps track of the load average of every host so the pool can
+// skip hosts that are already busy with someone else's work. Hosts are probed
+// together in the background once per interval and the results are cached in
+// between, so dispatching a command never waits on a probe.
+type loadProber struct {
+	mu       sync.Mutex
+	maxLoad  float64
+	interval time.Duration
+	loads    map[*host]float64
+	onUpdate func()
+}
+
+// newLoadProber creates a prober that considers hosts with a load average
+// above maxLoad overloaded. onUpdate is called after every sweep.
+func newLoadProber(maxLoad float64, interval time.Duration, onUpdate func()) *loadProber {
+	return &loadProber{
+		maxLoad:  maxLoad,
+		interval: interval,
+		loads:    make(map[*host]float64),
+		onUpdate: onUpdate,
+	}
+}
+
+// start probes hosts once before returning, so the first placements are
+// already informed, then keeps probing them in the background.
+func (lp *loadProber) start(hosts []*host) {
+	lp.sweep(hosts)
+	go func() {
+		for range time.Tick(lp.interval) {
+			lp.sweep(hosts)
+		}
+	}()
+}
+
+// sweep probes all hosts in parallel and records their load.
+func (lp *loadProber) sweep(hosts []*host) {
+	var wg sync.WaitGroup
+	for _, h := range hosts {
+		wg.Add(1)
+		go func(h *host) {
+			defer wg.Done()
+			load, err := probeLoad(h)
+			lp.mu.Lock()
+			if err != nil {
+				// Let the normal retry logic deal with unreachable hosts
+				logInfo("PROBE host=%v error=%v", h.name, err)
+				delete(lp.loads, h)
+			} else {
+				if load > lp.maxLoad {
+					logDetail("PROBE host=%v load=%v overloaded", h.name, load)
+				}
+				lp.loads[h] = load
+			}
+			lp.mu.Unlock()
+		}(h)
+	}
+	wg.Wait()
+	if lp.onUpdate != nil {
+		lp.onUpdate()
+	}
+}
+
+// overloaded reports whether the last probe saw h above the load threshold.
+func (lp *loadProber) overloaded(h *host) bool {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	load, ok := lp.loads[h]
+	return ok && load > lp.maxLoad
+}
+
+// probeLoad fetches the 1 minute load average of h.
+func probeLoad(h *host) (float64, error) {
+	var out bytes.Buffer
+	if err := tryCommand(context.Background(), loadProbeCommand, h, &out); err != nil {
+		return 0, err
+	}
+	return parseLoad(out.String())
+}
+
+// parseLoad reads the 1 minute load average out of either /proc/loadavg
+// ("0.52 0.58 0.59 1/467 12345") or uptime ("... load average: 0.52, 0.58, 0.59").
+func parseLoad(out string) (float64, error) {
+	if i := strings.LastIndex(out, "load average"); i >= 0 {
+		out = out[i+len("load average"):]
+		out = strings.TrimLeft(out, "s: ")
+	}
+	fields := strings.FieldsFunc(out, func(r rune) bool {
+		return r == ' ' || r == ',' || r == '\t' || r == '\n'
+	})
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("no load average in %q", out)
+	}
+	return strconv.ParseFloat(fields[0], 64)
+}
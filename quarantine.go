@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// How long a re-probe of a quarantined host may take
+const reprobeTimeout = 10 * time.Second
+
+// quarantine takes hosts that look dead out of the pool. A host goes into
+// quarantine after a number of connection failures in a row, and a background
+// goroutine re-probes it with `ssh host true` once per interval until it
+// answers, at which point it rejoins the pool.
+type quarantine struct {
+	mu        sync.Mutex
+	after     int
+	interval  time.Duration
+	failures  map[*host]int
+	held      map[*host]bool
+	onRelease func()
+}
+
+// newQuarantine creates a quarantine for hosts that failed to connect after
+// times in a row. onRelease is called whenever a host rejoins the pool.
+func newQuarantine(after int, interval time.Duration, onRelease func()) *quarantine {
+	return &quarantine{
+		after:     after,
+		interval:  interval,
+		failures:  make(map[*host]int),
+		held:      make(map[*host]bool),
+		onRelease: onRelease,
+	}
+}
+
+// record notes whether an attempt on h reached it, quarantining h once it
+// has failed too many times in a row.
+func (q *quarantine) record(h *host, reached bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if reached {
+		delete(q.failures, h)
+		return
+	}
+	q.failures[h]++
+	if q.failures[h] < q.after || q.held[h] {
+		return
+	}
+	q.held[h] = true
+	logInfo("QUARANTINE host=%v failures=%v", h.name, q.failures[h])
+	go q.reprobe(h)
+}
+
+// reprobe checks on h once per interval until it answers, then releases it.
+func (q *quarantine) reprobe(h *host) {
+	for {
+		time.Sleep(q.interval)
+		ctx, cancel := context.WithTimeout(context.Background(), reprobeTimeout)
+		err := tryCommand(ctx, probeCommand, h, io.Discard)
+		cancel()
+		if err == nil {
+			break
+		}
+		logDetail("PROBE host=%v still unreachable: %v", h.name, err)
+	}
+	q.mu.Lock()
+	delete(q.held, h)
+	delete(q.failures, h)
+	q.mu.Unlock()
+	logInfo("RELEASE host=%v back in the pool", h.name)
+	if q.onRelease != nil {
+		q.onRelease()
+	}
+}
+
+// quarantined reports whether h is currently kept out of the pool.
+func (q *quarantine) quarantined(h *host) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.held[h]
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"html/template"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// writeCSV writes the commands of the summary to path as CSV, one row each
+// after a header.
+func (s *runSummary) writeCSV(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	w.Write([]string{"id", "label", "command", "status", "host", "attempts", "exit_code", "duration_seconds", "output"})
+	for _, c := range s.Commands {
+		exit, duration := "", ""
+		if c.Exit != nil {
+			exit = strconv.Itoa(*c.Exit)
+		}
+		if c.Duration > 0 {
+			duration = strconv.FormatFloat(c.Duration, 'f', 3, 64)
+		}
+		w.Write([]string{strconv.Itoa(c.ID), c.Label, c.Command, c.Status, c.Host, strconv.Itoa(c.Attempts), exit, duration, c.Output})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// junitSuite is the root of a JUnit XML report, with a test case for each
+// command, for CI servers to show a run the way they show tests.
+type junitSuite struct {
+	XMLName  xml.Name    `xml:"testsuite"`
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Skipped  int         `xml:"skipped,attr"`
+	Time     float64     `xml:"time,attr"`
+	Stamp    string      `xml:"timestamp,attr"`
+	Cases    []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Skipped   *junitFailure `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr,omitempty"`
+	Text    string `xml:",chardata"`
+}
+
+// writeJUnit writes the commands of the summary to path as a JUnit XML test
+// suite. Commands that never started are skipped test cases, and the output
+// directory of each command is its system-out.
+func (s *runSummary) writeJUnit(path string) error {
+	suite := junitSuite{
+		Name:  "disgo " + s.RunID,
+		Tests: s.Total,
+		Time:  s.Duration,
+		Stamp: s.Started.Format("2006-01-02T15:04:05"),
+	}
+	for _, c := range s.Commands {
+		tc := junitCase{Name: c.Command, Classname: "disgo." + c.Host, Time: c.Duration}
+		if c.Label != "" {
+			tc.Name = c.Label
+		}
+		if c.Host == "" {
+			tc.Classname = "disgo"
+		}
+		if c.Output != "" {
+			tc.SystemOut = "output: " + c.Output
+		}
+		switch c.Status {
+		case "succeeded":
+		case "not-started", "abandoned":
+			suite.Skipped++
+			tc.Skipped = &junitFailure{Message: c.Status}
+		default:
+			suite.Failures++
+			msg := c.Status
+			if c.Exit != nil {
+				msg += fmt.Sprintf(", exit code %v", *c.Exit)
+			}
+			tc.Failure = &junitFailure{
+				Message: msg,
+				Type:    c.Cause,
+				Text:    fmt.Sprintf("%v\n%v after %v attempts", c.Command, c.Status, c.Attempts),
+			}
+		}
+		suite.Cases = append(suite.Cases, tc)
+	}
+	data, err := xml.MarshalIndent(suite, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append([]byte(xml.Header), append(data, '\n')...), 0644)
+}
+
+// writeHTML writes the summary to path as a single HTML page that needs
+// nothing else to be read: a table of the commands that sorts by any column,
+// a bar per host of how busy it was, and links to the output files of each
+// command relative to the page.
+func (s *runSummary) writeHTML(path string) error {
+	dir, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	type file struct{ Name, Href string }
+	type row struct {
+		commandSummary
+		Exit  string
+		Files []file
+	}
+	var rows []row
+	for _, c := range s.Commands {
+		r := row{commandSummary: c}
+		if c.Exit != nil {
+			r.Exit = strconv.Itoa(*c.Exit)
+		}
+		if c.Output != "" {
+			entries, _ := os.ReadDir(c.Output)
+			for _, e := range entries {
+				abs, err := filepath.Abs(filepath.Join(c.Output, e.Name()))
+				if err != nil {
+					continue
+				}
+				if rel, err := filepath.Rel(dir, abs); err == nil {
+					abs = rel
+				}
+				r.Files = append(r.Files, file{e.Name(), filepath.ToSlash(abs)})
+			}
+		}
+		rows = append(rows, r)
+	}
+	busiest := 0.0
+	for _, h := range s.Hosts {
+		busiest = math.Max(busiest, h.Busy)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = reportTemplate.Execute(f, map[string]interface{}{
+		"Run":     s,
+		"Rows":    rows,
+		"Busiest": busiest,
+	})
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"pct": func(v, of float64) string {
+		if of <= 0 {
+			return "0"
+		}
+		return strconv.FormatFloat(100*v/of, 'f', 1, 64)
+	},
+	"secs": func(v float64) string { return strconv.FormatFloat(v, 'f', 3, 64) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>disgo {{.Run.RunID}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; vertical-align: top; }
+th { background: #eee; cursor: pointer; user-select: none; }
+td.num { text-align: right; }
+code { white-space: pre-wrap; }
+tr.succeeded td.status { color: #080; }
+tr.failed td.status, tr.permanent td.status, tr.failed-fast td.status, tr.undone td.status { color: #c00; }
+tr.abandoned td.status, tr.not-started td.status { color: #888; }
+.bar { background: #ddd; width: 20em; }
+.bar div { background: #48c; height: 1em; }
+</style>
+</head>
+<body>
+<h1>disgo run {{.Run.RunID}}</h1>
+<p>Started {{.Run.Started.Format "2006-01-02 15:04:05"}}, took {{secs .Run.Duration}}s.
+{{.Run.Succeeded}} of {{.Run.Total}} commands succeeded, {{.Run.Failed}} did not.
+{{with .Run.Durations}}Commands that succeeded took {{secs .P50}}s at the median, {{secs .P99}}s at p99 and {{secs .Max}}s at most.{{end}}</p>
+{{with .Run.Causes}}<h2>Failures</h2>
+<table>
+<tr><th>Cause</th><th>Commands</th></tr>
+{{range $cause, $n := .}}<tr><td>{{$cause}}</td><td class="num">{{$n}}</td></tr>
+{{end}}</table>
+{{end}}
+<h2>Hosts</h2>
+<table class="sortable">
+<tr><th>Host</th><th>Attempts</th><th>Failures</th><th>Busy (s)</th><th></th></tr>
+{{range .Run.Hosts}}<tr><td>{{.Host}}</td><td class="num">{{.Attempts}}</td><td class="num">{{.Failures}}</td><td class="num">{{secs .Busy}}</td><td><div class="bar"><div style="width: {{pct .Busy $.Busiest}}%"></div></div></td></tr>
+{{end}}</table>
+<h2>Commands</h2>
+<table class="sortable">
+<tr><th>ID</th><th>Label</th><th>Command</th><th>Status</th><th>Host</th><th>Attempts</th><th>Exit code</th><th>Duration (s)</th><th>Cause</th><th>Output</th></tr>
+{{range .Rows}}<tr class="{{.Status}}"><td class="num">{{.ID}}</td><td>{{.Label}}</td><td><code>{{.Command}}</code></td><td class="status">{{.Status}}</td><td>{{.Host}}</td><td class="num">{{.Attempts}}</td><td class="num">{{.Exit}}</td><td class="num">{{if .Duration}}{{secs .Duration}}{{end}}</td><td>{{.Cause}}</td><td>{{range .Files}}<a href="{{.Href}}">{{.Name}}</a> {{end}}</td></tr>
+{{end}}</table>
+<script>
+document.querySelectorAll("table.sortable").forEach(function (table) {
+  var headers = table.rows[0].cells;
+  for (var i = 0; i < headers.length; i++) {
+    (function (col) {
+      var up = true;
+      headers[col].onclick = function () {
+        var rows = Array.prototype.slice.call(table.rows, 1);
+        rows.sort(function (a, b) {
+          var x = a.cells[col].textContent, y = b.cells[col].textContent;
+          var n = parseFloat(x) - parseFloat(y);
+          var c = isNaN(n) ? x.localeCompare(y) : n;
+          return up ? c : -c;
+        });
+        up = !up;
+        rows.forEach(function (r) { table.tBodies[0].appendChild(r); });
+      };
+    })(i);
+  }
+});
+</script>
+</body>
+</html>
+`))
@@ -0,0 +1,40 @@
+package scheduler
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Backoff spaces out retries: the first retry waits Base, and every one after
+// that waits Multiplier times longer than the last, up to Max. With Jitter,
+// every delay is then spread randomly by up to that fraction either way, so
+// that work which failed at the same moment doesn't all retry at the same
+// moment too.
+type Backoff struct {
+	Base       time.Duration
+	Multiplier float64
+	Max        time.Duration // 0 for no cap
+	Jitter     float64       // between 0 and 1
+}
+
+// Delay returns how long to wait before retry number n, counting from 1.
+func (b Backoff) Delay(n int) time.Duration {
+	if n < 1 || b.Base <= 0 {
+		return 0
+	}
+	delay := float64(b.Base)
+	for i := 1; i < n; i++ {
+		delay *= b.Multiplier
+		if b.Max > 0 && delay >= float64(b.Max) {
+			delay = float64(b.Max)
+			break
+		}
+	}
+	if b.Max > 0 && delay > float64(b.Max) {
+		delay = float64(b.Max)
+	}
+	if b.Jitter > 0 {
+		delay *= 1 - b.Jitter + 2*b.Jitter*rand.Float64()
+	}
+	return time.Duration(delay)
+}
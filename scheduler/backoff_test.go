@@ -0,0 +1,54 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	exp := Backoff{Base: time.Second, Multiplier: 2}
+	capped := Backoff{Base: time.Second, Multiplier: 3, Max: 10 * time.Second}
+	tests := []struct {
+		name string
+		b    Backoff
+		n    int
+		want time.Duration
+	}{
+		{"no retry yet", exp, 0, 0},
+		{"first retry waits base", exp, 1, time.Second},
+		{"second retry", exp, 2, 2 * time.Second},
+		{"fifth retry", exp, 5, 16 * time.Second},
+		{"below the cap", capped, 3, 9 * time.Second},
+		{"at the cap", capped, 4, 10 * time.Second},
+		{"far past the cap", capped, 1000, 10 * time.Second},
+		{"base over the cap", Backoff{Base: time.Minute, Multiplier: 2, Max: time.Second}, 1, time.Second},
+		{"constant", Backoff{Base: time.Second, Multiplier: 1}, 7, time.Second},
+		{"no base", Backoff{Multiplier: 2}, 3, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.b.Delay(tt.n); got != tt.want {
+				t.Errorf("Delay(%v) = %v, want %v", tt.n, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	tests := []struct {
+		jitter   float64
+		min, max time.Duration
+	}{
+		{0.1, 18 * time.Second, 22 * time.Second},
+		{0.5, 10 * time.Second, 30 * time.Second},
+		{1, 0, 40 * time.Second},
+	}
+	for _, tt := range tests {
+		b := Backoff{Base: 10 * time.Second, Multiplier: 2, Jitter: tt.jitter}
+		for i := 0; i < 100; i++ {
+			if got := b.Delay(2); got < tt.min || got > tt.max {
+				t.Fatalf("with jitter %v, Delay(2) = %v, want between %v and %v", tt.jitter, got, tt.min, tt.max)
+			}
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package scheduler
+
+import (
+	"container/heap"
+	"sort"
+	"time"
+)
+
+// EstimateMakespan predicts how long it takes to run work items of the given
+// durations on a number of identical slots when they are handed out longest
+// first, which is the longest processing time (LPT) heuristic.
+func EstimateMakespan(durations []time.Duration, slots int) time.Duration {
+	if slots < 1 {
+		slots = 1
+	}
+	sorted := make([]time.Duration, len(durations))
+	copy(sorted, durations)
+	sort.Sort(sort.Reverse(durationSlice(sorted)))
+
+	// Each item goes to whichever slot frees up first
+	free := make(durationHeap, slots)
+	var makespan time.Duration
+	for _, d := range sorted {
+		end := free[0] + d
+		free[0] = end
+		heap.Fix(&free, 0)
+		if end > makespan {
+			makespan = end
+		}
+	}
+	return makespan
+}
+
+type durationSlice []time.Duration
+
+func (s durationSlice) Len() int           { return len(s) }
+func (s durationSlice) Less(i, k int) bool { return s[i] < s[k] }
+func (s durationSlice) Swap(i, k int)      { s[i], s[k] = s[k], s[i] }
+
+// durationHeap is a min-heap of the times at which slots become free
+type durationHeap []time.Duration
+
+func (h durationHeap) Len() int            { return len(h) }
+func (h durationHeap) Less(i, k int) bool  { return h[i] < h[k] }
+func (h durationHeap) Swap(i, k int)       { h[i], h[k] = h[k], h[i] }
+func (h *durationHeap) Push(x interface{}) { *h = append(*h, x.(time.Duration)) }
+func (h *durationHeap) Pop() interface{} {
+	old := *h
+	d := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return d
+}
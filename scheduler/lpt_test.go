@@ -0,0 +1,39 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEstimateMakespan(t *testing.T) {
+	s := time.Second
+	tests := []struct {
+		name      string
+		durations []time.Duration
+		slots     int
+		want      time.Duration
+	}{
+		{"nothing to run", nil, 4, 0},
+		{"one slot runs everything in turn", []time.Duration{1 * s, 2 * s, 3 * s}, 1, 6 * s},
+		{"no slots counts as one", []time.Duration{1 * s, 2 * s}, 0, 3 * s},
+		{"a slot each", []time.Duration{1 * s, 5 * s, 3 * s}, 3, 5 * s},
+		{"more slots than work", []time.Duration{2 * s}, 8, 2 * s},
+		{"longest first", []time.Duration{2 * s, 2 * s, 3 * s, 3 * s, 2 * s}, 2, 7 * s},
+		{"the longest item bounds it", []time.Duration{10 * s, 1 * s, 1 * s, 1 * s}, 2, 10 * s},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := EstimateMakespan(tt.durations, tt.slots); got != tt.want {
+				t.Errorf("EstimateMakespan(%v, %v) = %v, want %v", tt.durations, tt.slots, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEstimateMakespanLeavesInput(t *testing.T) {
+	durations := []time.Duration{time.Second, 3 * time.Second, 2 * time.Second}
+	EstimateMakespan(durations, 2)
+	if durations[0] != time.Second || durations[1] != 3*time.Second || durations[2] != 2*time.Second {
+		t.Errorf("EstimateMakespan reordered its input to %v", durations)
+	}
+}
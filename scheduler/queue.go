@@ -0,0 +1,125 @@
+// Package scheduler holds the queue that commands wait in before a worker
+// picks them up. It knows nothing about hosts or ssh, only about the order in
+// which work is handed out.
+package scheduler
+
+import (
+	"container/heap"
+	"errors"
+	"sync"
+)
+
+// ErrClosed is returned when pushing onto a closed Queue.
+var ErrClosed = errors.New("scheduler: queue closed")
+
+// Queue is a blocking priority queue. Items with a higher priority are popped
+// first, and items of equal priority come out in the order they were pushed.
+// Items can be pushed on behalf of different sources, in which case equal
+// priorities are shared out fairly: each source's first item comes before any
+// source's second item, and so on, so one big source can't starve the others.
+// A Queue with a capacity applies backpressure: Push blocks while it is full.
+type Queue struct {
+	mu       sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	items    items
+	seq      uint64
+	rounds   map[string]uint64 // items pushed so far per source
+	capacity int
+	closed   bool
+}
+
+// NewQueue creates a queue holding at most capacity items. A capacity of zero
+// or less means unbounded.
+func NewQueue(capacity int) *Queue {
+	q := &Queue{capacity: capacity, rounds: make(map[string]uint64)}
+	q.notEmpty = sync.NewCond(&q.mu)
+	q.notFull = sync.NewCond(&q.mu)
+	return q
+}
+
+// Push adds v to the queue with the given priority, waiting for room if the
+// queue is full.
+func (q *Queue) Push(v interface{}, priority int) error {
+	return q.PushFrom("", v, priority)
+}
+
+// PushFrom is like Push, but shares the queue fairly between v's source and
+// any other sources.
+func (q *Queue) PushFrom(source string, v interface{}, priority int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for !q.closed && q.capacity > 0 && len(q.items) >= q.capacity {
+		q.notFull.Wait()
+	}
+	if q.closed {
+		return ErrClosed
+	}
+	heap.Push(&q.items, &item{value: v, priority: priority, round: q.rounds[source], seq: q.seq})
+	q.rounds[source]++
+	q.seq++
+	q.notEmpty.Signal()
+	return nil
+}
+
+// Pop removes and returns the next item, waiting for one to be pushed if the
+// queue is empty. It returns false once the queue is closed and drained.
+func (q *Queue) Pop() (interface{}, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for !q.closed && len(q.items) == 0 {
+		q.notEmpty.Wait()
+	}
+	if len(q.items) == 0 {
+		return nil, false
+	}
+	it := heap.Pop(&q.items).(*item)
+	q.notFull.Signal()
+	return it.value, true
+}
+
+// Len returns the number of items waiting in the queue.
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
+
+// Close stops the queue from accepting new items. Items already queued can
+// still be popped.
+func (q *Queue) Close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.notEmpty.Broadcast()
+	q.notFull.Broadcast()
+}
+
+type item struct {
+	value    interface{}
+	priority int
+	round    uint64 // position within its source
+	seq      uint64 // push order, to keep equal priorities FIFO
+}
+
+// items implements heap.Interface
+type items []*item
+
+func (h items) Len() int { return len(h) }
+func (h items) Less(i, k int) bool {
+	if h[i].priority != h[k].priority {
+		return h[i].priority > h[k].priority
+	}
+	if h[i].round != h[k].round {
+		return h[i].round < h[k].round
+	}
+	return h[i].seq < h[k].seq
+}
+func (h items) Swap(i, k int)       { h[i], h[k] = h[k], h[i] }
+func (h *items) Push(x interface{}) { *h = append(*h, x.(*item)) }
+func (h *items) Pop() interface{} {
+	old := *h
+	it := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return it
+}
@@ -0,0 +1,141 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+)
+
+// drain pops every item of a closed queue.
+func drain(q *Queue) []interface{} {
+	var got []interface{}
+	for {
+		v, ok := q.Pop()
+		if !ok {
+			return got
+		}
+		got = append(got, v)
+	}
+}
+
+func TestQueueOrder(t *testing.T) {
+	type push struct {
+		source   string
+		v        string
+		priority int
+	}
+	tests := []struct {
+		name   string
+		pushes []push
+		want   []string
+	}{
+		{
+			name:   "higher priority first",
+			pushes: []push{{"", "low", 0}, {"", "high", 10}, {"", "mid", 5}, {"", "negative", -1}},
+			want:   []string{"high", "mid", "low", "negative"},
+		},
+		{
+			name:   "equal priorities in push order",
+			pushes: []push{{"", "a", 1}, {"", "b", 1}, {"", "c", 1}, {"", "d", 1}},
+			want:   []string{"a", "b", "c", "d"},
+		},
+		{
+			name:   "push order within each priority",
+			pushes: []push{{"", "a", 0}, {"", "b", 2}, {"", "c", 0}, {"", "d", 2}},
+			want:   []string{"b", "d", "a", "c"},
+		},
+		{
+			name:   "sources take turns",
+			pushes: []push{{"x", "x1", 0}, {"x", "x2", 0}, {"x", "x3", 0}, {"y", "y1", 0}, {"y", "y2", 0}},
+			want:   []string{"x1", "y1", "x2", "y2", "x3"},
+		},
+		{
+			name:   "priority before turns",
+			pushes: []push{{"x", "x1", 0}, {"x", "x2", 1}, {"y", "y1", 0}},
+			want:   []string{"x2", "x1", "y1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := NewQueue(0)
+			for _, p := range tt.pushes {
+				if err := q.PushFrom(p.source, p.v, p.priority); err != nil {
+					t.Fatalf("PushFrom(%q, %q, %v) = %v", p.source, p.v, p.priority, err)
+				}
+			}
+			if n := q.Len(); n != len(tt.pushes) {
+				t.Errorf("Len() = %v, want %v", n, len(tt.pushes))
+			}
+			q.Close()
+			got := drain(q)
+			if len(got) != len(tt.want) {
+				t.Fatalf("popped %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("popped %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestQueueCloseWakesPop(t *testing.T) {
+	q := NewQueue(0)
+	done := make(chan bool)
+	for i := 0; i < 3; i++ {
+		go func() {
+			_, ok := q.Pop()
+			done <- ok
+		}()
+	}
+	// Give the pops time to block
+	time.Sleep(10 * time.Millisecond)
+	q.Close()
+	for i := 0; i < 3; i++ {
+		select {
+		case ok := <-done:
+			if ok {
+				t.Errorf("Pop() on a closed, empty queue returned ok")
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Pop() still blocked after Close")
+		}
+	}
+}
+
+func TestQueueClosedPush(t *testing.T) {
+	q := NewQueue(0)
+	q.Push("a", 0)
+	q.Close()
+	if err := q.Push("b", 0); err != ErrClosed {
+		t.Errorf("Push() after Close = %v, want ErrClosed", err)
+	}
+	if v, ok := q.Pop(); !ok || v != "a" {
+		t.Errorf("Pop() after Close = %v, %v, want a, true", v, ok)
+	}
+}
+
+func TestQueueCapacity(t *testing.T) {
+	q := NewQueue(1)
+	q.Push("a", 0)
+	pushed := make(chan error)
+	go func() {
+		pushed <- q.Push("b", 0)
+	}()
+	select {
+	case <-pushed:
+		t.Fatalf("Push() onto a full queue didn't wait")
+	case <-time.After(10 * time.Millisecond):
+	}
+	if v, _ := q.Pop(); v != "a" {
+		t.Errorf("Pop() = %v, want a", v)
+	}
+	select {
+	case err := <-pushed:
+		if err != nil {
+			t.Errorf("Push() = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Push() still blocked after Pop made room")
+	}
+}
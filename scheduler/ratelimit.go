@@ -0,0 +1,50 @@
+package scheduler
+
+import (
+	"sync"
+	"time"
+)
+
+// TokenBucket limits how fast work is handed out. Tokens refill at a steady
+// rate up to the bucket size, and every Wait spends one.
+type TokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket creates a full bucket that refills at rate tokens per second
+// and holds at most burst tokens.
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &TokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Wait blocks until a token is available and spends it. Callers are served in
+// the order they arrive: a caller that finds the bucket empty reserves the
+// next token and sleeps until it has refilled.
+func (b *TokenBucket) Wait() {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens--
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+	time.Sleep(delay)
+}
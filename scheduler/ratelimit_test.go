@@ -0,0 +1,33 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	tests := []struct {
+		name     string
+		rate     float64
+		burst    int
+		waits    int
+		min, max time.Duration
+	}{
+		{name: "burst is free", rate: 10, burst: 5, waits: 5, min: 0, max: 50 * time.Millisecond},
+		{name: "past the burst at the rate", rate: 100, burst: 1, waits: 6, min: 40 * time.Millisecond, max: 150 * time.Millisecond},
+		{name: "burst then rate", rate: 100, burst: 3, waits: 8, min: 40 * time.Millisecond, max: 150 * time.Millisecond},
+		{name: "burst of at least 1", rate: 100, burst: 0, waits: 1, min: 0, max: 50 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewTokenBucket(tt.rate, tt.burst)
+			start := time.Now()
+			for i := 0; i < tt.waits; i++ {
+				b.Wait()
+			}
+			if took := time.Since(start); took < tt.min || took > tt.max {
+				t.Errorf("%v waits took %v, want between %v and %v", tt.waits, took, tt.min, tt.max)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// How much weight a new attempt gets in the moving averages of a host's score
+const scoreAlpha = 0.2
+
+// Floor for scores, so a host that had a bad patch still gets the odd command
+// and can earn its way back
+const minScore = 0.05
+
+// hostScores keeps a rolling record of how well each host has been doing:
+// the share of attempts that succeeded and how long successful ones took
+// compared to the other hosts. Its methods are called with the pool locked.
+type hostScores struct {
+	success  map[*host]float64       // moving average of 1 per success, 0 per failure
+	latency  map[*host]time.Duration // moving average of successful run times
+	attempts map[*host]int
+	failures map[*host]int
+	fleet    time.Duration // mean latency over the hosts that have one
+}
+
+func newHostScores() *hostScores {
+	return &hostScores{
+		success:  make(map[*host]float64),
+		latency:  make(map[*host]time.Duration),
+		attempts: make(map[*host]int),
+		failures: make(map[*host]int),
+	}
+}
+
+// record updates the score of h after an attempt that ran for elapsed.
+func (s *hostScores) record(h *host, ok bool, elapsed time.Duration) {
+	s.attempts[h]++
+	outcome := 1.0
+	if !ok {
+		outcome = 0
+		s.failures[h]++
+	}
+	if rate, seen := s.success[h]; seen {
+		s.success[h] = rate*(1-scoreAlpha) + outcome*scoreAlpha
+	} else {
+		s.success[h] = outcome
+	}
+	if !ok {
+		return
+	}
+	if avg, seen := s.latency[h]; seen {
+		s.latency[h] = time.Duration(float64(avg)*(1-scoreAlpha) + float64(elapsed)*scoreAlpha)
+	} else {
+		s.latency[h] = elapsed
+	}
+	var total time.Duration
+	for _, avg := range s.latency {
+		total += avg
+	}
+	s.fleet = total / time.Duration(len(s.latency))
+}
+
+// score rates h between minScore and 1: its success rate, scaled down by how
+// much slower than the fleet it is. Hosts with no record score 1.
+func (s *hostScores) score(h *host) float64 {
+	score := 1.0
+	if rate, seen := s.success[h]; seen {
+		score = rate
+	}
+	if avg := s.latency[h]; avg > s.fleet && avg > 0 {
+		score *= float64(s.fleet) / float64(avg)
+	}
+	return math.Max(score, minScore)
+}
+
+// report logs the score of every host that was given any work.
+func (s *hostScores) report(hosts []*host) {
+	for _, h := range hosts {
+		if s.attempts[h] == 0 {
+			continue
+		}
+		logInfo("SCORE host=%v score=%.2f success=%.2f latency=%v attempts=%v failures=%v",
+			h.name, s.score(h), s.success[h], s.latency[h].Round(time.Millisecond), s.attempts[h], s.failures[h])
+	}
+}
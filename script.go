@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Largest script -scripts sends. It travels in the command line, which the
+// host's shell gets as a single argument, and Linux caps those at 128KiB.
+const maxScriptSize = 64 << 10
+
+// loadScript reads the local script the command of j names for -scripts,
+// the path first and then its arguments.
+func loadScript(j *job) error {
+	path, _, _ := strings.Cut(strings.TrimSpace(j.command), " ")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("command %v: %v", j.id, err)
+	}
+	if len(data) > maxScriptSize {
+		return fmt.Errorf("command %v: %v is %v bytes, more than the %v a script can be", j.id, path, len(data), maxScriptSize)
+	}
+	j.script = data
+	return nil
+}
+
+// scriptCommand returns the command that runs the script of j on a host with
+// the arguments command gives it: the script is written to a temporary
+// file, run and then removed, however it exits.
+func scriptCommand(j *job, command string) string {
+	_, args, _ := strings.Cut(strings.TrimSpace(command), " ")
+	encoded := base64.StdEncoding.EncodeToString(j.script)
+	run := `f=$(mktemp "${TMPDIR:-/tmp}/disgo.XXXXXX") || exit 1; trap 'rm -f "$f"' EXIT; ` +
+		`printf %s ` + encoded + ` | base64 -d > "$f" && chmod +x "$f" && "$f" ` + args + `; exit $?`
+	// In a shell of its own so the trap is its own
+	return "sh -c " + shellQuote(run)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/a10y/disgo/sshclient"
+)
+
+// ssh exits with this status when it couldn't reach the host or log in
+const sshFailed = 255
+
+// nativeSSH, if set, runs remote commands in process instead of through the
+// ssh binary
+var nativeSSH *sshclient.Client
+
+// controlDir, if set, holds the ControlMaster sockets the ssh binary shares
+// one connection per host through
+var controlDir string
+
+// sshOptions are -o options passed to every ssh invocation
+var sshOptions []string
+
+// sshExecutor runs commands through the ssh binary. Cancelling ctx kills the
+// local ssh process.
+type sshExecutor struct{}
+
+func (sshExecutor) run(ctx context.Context, h *host, command string, opts runOptions, stdout, stderr io.Writer) (exitStatus, error) {
+	// ssh takes the first value it is given for an option, so the most
+	// specific options go first
+	var args []string
+	for _, opt := range h.sshOpts {
+		args = append(args, "-o", opt)
+	}
+	for _, opt := range sshOptions {
+		args = append(args, "-o", opt)
+	}
+	if len(commandEnv) > 0 {
+		args = append(args, "-o", setEnvOption(commandEnv))
+	}
+	args = append(args, "-o", "ConnectTimeout=2")
+	if h.user != "" {
+		args = append(args, "-l", h.user)
+	}
+	if h.port != 0 {
+		args = append(args, "-p", strconv.Itoa(h.port))
+	}
+	if h.key != "" {
+		args = append(args, "-i", h.key)
+	}
+	if h.jump != "" {
+		args = append(args, "-J", h.jump)
+	}
+	if controlDir != "" {
+		args = append(args, "-o", "ControlPath="+controlDir+"/%C", "-o", "ControlPersist=60s")
+		openMaster(ctx, h, args)
+		args = append(args, "-o", "ControlMaster=auto")
+	}
+	if opts.pty {
+		// Forced, since our own stdin isn't a terminal. ssh then says when
+		// the connection closes, which is no news in a command's output.
+		args = append(args, "-tt", "-o", "LogLevel=ERROR")
+	}
+	cmd := exec.CommandContext(ctx, "ssh", append(args, h.name, command)...)
+	logTrace("SSH host=%v args=%q", h.name, cmd.Args[1:])
+	cmd.Stdin = opts.stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.Env = passwordEnviron()
+	// Don't wait on a master that went to the background holding our pipes
+	cmd.WaitDelay = time.Second
+	err := cmd.Run()
+	status, runErr := processStatus(err)
+	if status == sshFailed {
+		// Can't tell from a command exiting with 255, but it's far more
+		// likely ssh itself
+		return 0, err
+	}
+	return status, runErr
+}
+
+// A master is the ControlMaster connection to a host.
+type master struct {
+	mu     sync.Mutex
+	name   string
+	args   []string // ssh options it was opened with
+	opened bool
+	failed time.Time // when it last failed to open
+}
+
+// How long after failing to open a master another attempt waits, commands
+// meanwhile connecting by themselves
+const masterRetry = 10 * time.Second
+
+// masters holds the ControlMaster connection of each host, by user@name:port
+var masters sync.Map
+
+// openMaster opens the ControlMaster connection to h with the ssh options
+// in args, unless it was already opened or failed to open moments ago.
+// Commands started at once would otherwise all find no master and each open
+// their own connection. If the master exits later for being idle, the next
+// command opens another.
+func openMaster(ctx context.Context, h *host, args []string) {
+	v, _ := masters.LoadOrStore(fmt.Sprintf("%v@%v:%v", h.user, h.name, h.port), &master{name: h.name})
+	m := v.(*master)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.opened || time.Since(m.failed) < masterRetry {
+		return
+	}
+	// Backgrounds itself once connected
+	cmd := exec.CommandContext(ctx, "ssh", append(slices.Clip(args), "-o", "ControlMaster=yes", "-f", "-N", h.name)...)
+	logTrace("SSH host=%v opening the master connection", h.name)
+	cmd.Env = passwordEnviron()
+	if err := cmd.Run(); err != nil {
+		// The command then connects by itself, and fails saying why if it
+		// can't either
+		logDetail("SSH host=%v could not open the master connection: %v", h.name, err)
+		m.failed = time.Now()
+		return
+	}
+	m.opened, m.args = true, slices.Clone(args)
+}
+
+// closeMasters asks every master connection that was opened to exit, for
+// none to be left running once their sockets are gone.
+func closeMasters() {
+	masters.Range(func(_, v any) bool {
+		m := v.(*master)
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if m.opened {
+			// Fails if it already exited for being idle, which is as good
+			cmd := exec.Command("ssh", append(m.args, "-O", "exit", m.name)...)
+			logTrace("SSH host=%v closing the master connection", m.name)
+			cmd.Run()
+			m.opened = false
+		}
+		return true
+	})
+}
+
+// setEnvOption returns the SetEnv option setting the KEY=VALUE pairs of env.
+// They must all go in the one option, since ssh only takes the first SetEnv
+// it is given.
+func setEnvOption(env []string) string {
+	vars := make([]string, len(env))
+	for i, kv := range env {
+		key, value, _ := strings.Cut(kv, "=")
+		vars[i] = key + "=" + sshQuote(value)
+	}
+	return "SetEnv=" + strings.Join(vars, " ")
+}
+
+// sshQuote quotes s as a value in ssh options.
+func sshQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// nativeExecutor runs commands with the built in SSH client.
+type nativeExecutor struct {
+	client *sshclient.Client
+}
+
+func (e nativeExecutor) run(ctx context.Context, h *host, command string, opts runOptions, stdout, stderr io.Writer) (exitStatus, error) {
+	target := sshclient.Target{Host: h.name, User: h.user, Port: h.port, KeyFile: h.key}
+	if h.jump != "" {
+		// Already checked when the host was parsed
+		hops, _ := parseJump(h.jump)
+		for _, hop := range hops {
+			target.Jump = append(target.Jump, sshclient.Target{Host: hop.name, User: hop.user, Port: hop.port})
+		}
+	}
+	err := e.client.Run(ctx, target, command, sshclient.Options{Stdin: opts.stdin, PTY: opts.pty}, stdout, stderr)
+	var exitErr *sshclient.ExitError
+	if errors.As(err, &exitErr) {
+		if exitErr.Signal != "" || exitErr.Status == 0 {
+			return -1, nil
+		}
+		return exitStatus(exitErr.Status), nil
+	}
+	return 0, err
+}
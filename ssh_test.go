@@ -0,0 +1,46 @@
+package main
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestSetEnvOption(t *testing.T) {
+	tests := []struct {
+		env  []string
+		want string
+	}{
+		{[]string{"A=1"}, `SetEnv=A="1"`},
+		{[]string{"A=1", "B=2", "C=3"}, `SetEnv=A="1" B="2" C="3"`},
+		{[]string{"MSG=hello world", "Q=say \"hi\"", "EMPTY="}, `SetEnv=MSG="hello world" Q="say \"hi\"" EMPTY=""`},
+		{[]string{`PATHS=C:\bin`}, `SetEnv=PATHS="C:\\bin"`},
+	}
+	for _, tt := range tests {
+		if got := setEnvOption(tt.env); got != tt.want {
+			t.Errorf("setEnvOption(%q) = %v, want %v", tt.env, got, tt.want)
+		}
+	}
+}
+
+// ssh itself must see every variable, which it doesn't if they are given
+// as separate SetEnv options.
+func TestSetEnvOptionSSH(t *testing.T) {
+	if _, err := exec.LookPath("ssh"); err != nil {
+		t.Skip("no ssh binary")
+	}
+	env := []string{"A=1", "B=two words", `C=a"b`}
+	out, err := exec.Command("ssh", "-G", "-o", setEnvOption(env), "example.com").Output()
+	if err != nil {
+		t.Fatalf("ssh -G: %v", err)
+	}
+	var got []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if value, ok := strings.CutPrefix(line, "setenv "); ok {
+			got = append(got, value)
+		}
+	}
+	if strings.Join(got, "\n") != strings.Join(env, "\n") {
+		t.Errorf("ssh set %q, want %q", got, env)
+	}
+}
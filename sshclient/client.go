@@ -0,0 +1,534 @@
+// Package sshclient runs commands on remote hosts over SSH, without shelling
+// out to an ssh binary. Unlike the ssh command line tool it reports why a
+// command failed with distinct error types: the host could not be reached,
+// it would not let us in, or the command itself exited with an error.
+package sshclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Config says how to connect to hosts.
+type Config struct {
+	User       string
+	Port       int      // 22 if zero
+	KeyFiles   []string // private keys to offer after the agent's, the usual ones in ~/.ssh if empty
+	KnownHosts string   // known_hosts file to check host keys against, ~/.ssh/known_hosts if empty
+	HostKeys   HostKeyChecking
+	// Password, if set, is tried after the keys, for both password and
+	// keyboard-interactive logins
+	Password       string
+	ConnectTimeout time.Duration
+	// Reuse keeps connections open and runs later commands on the same
+	// target as further sessions over them, rather than connecting afresh
+	Reuse       bool
+	MaxSessions int      // sessions to run over one connection at once, 10 if zero, as sshd allows by default
+	Ciphers     []string // to offer, most preferred first, x/crypto/ssh's defaults if empty
+	// Env holds KEY=VALUE pairs to set in the environment of commands, which
+	// hosts drop unless their AcceptEnv lets them through
+	Env []string
+	// Trace, if set, is called with a message for every connection opened,
+	// reused or dropped and every command run
+	Trace func(format string, args ...interface{})
+}
+
+// A Target is a host to run a command on. Fields left empty fall back to the
+// client's Config.
+type Target struct {
+	Host    string
+	User    string
+	Port    int
+	KeyFile string // offered instead of the configured keys
+	// Jump lists the hosts to hop through to reach Host, nearest first, like
+	// ssh's ProxyJump
+	Jump []Target
+}
+
+// A Client runs commands on any number of hosts. It is safe for concurrent
+// use.
+type Client struct {
+	cfg      Config
+	hostKeys ssh.HostKeyCallback
+	agent    agent.ExtendedAgent // nil without SSH_AUTH_SOCK
+	signers  []ssh.Signer        // from key files
+	skipped  []string            // why default key files could not be used
+
+	mu      sync.Mutex
+	keys    map[string]ssh.Signer    // keys of targets, by path
+	conns   map[string][]*sharedConn // open connections, by target
+	dialing map[string]*pendingDial  // connections being opened, by target
+}
+
+// A pendingDial is a connection being opened, which other sessions to the
+// same target wait for rather than opening their own.
+type pendingDial struct {
+	done chan struct{}
+	err  error // why it failed, once done is closed
+}
+
+// A sharedConn is a connection kept open to run sessions over.
+type sharedConn struct {
+	client   *ssh.Client
+	closeAll func()
+	sessions int // running over it now
+	limit    int // most sessions to run over it, lowered if the host takes fewer
+}
+
+// New creates a client from cfg. It authenticates with the keys held by the
+// ssh agent at SSH_AUTH_SOCK if there is one, then with the key files. Keys
+// and known hosts are loaded up front so that a broken key file is reported
+// before anything runs.
+func New(cfg Config) (*Client, error) {
+	home, _ := os.UserHomeDir()
+	c := &Client{cfg: cfg, keys: make(map[string]ssh.Signer), conns: make(map[string][]*sharedConn), dialing: make(map[string]*pendingDial)}
+	if c.cfg.MaxSessions == 0 {
+		c.cfg.MaxSessions = 10
+	}
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			return nil, fmt.Errorf("connecting to the ssh agent at SSH_AUTH_SOCK: %w", err)
+		}
+		c.agent = agent.NewClient(conn)
+	}
+	if len(cfg.KeyFiles) > 0 {
+		for _, path := range cfg.KeyFiles {
+			signer, err := loadKey(path)
+			if err != nil {
+				return nil, err
+			}
+			c.signers = append(c.signers, signer)
+		}
+	} else {
+		// The usual suspects, skipping the ones we can't use, such as keys
+		// protected by a passphrase that only the agent can unlock
+		for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+			path := filepath.Join(home, ".ssh", name)
+			if _, err := os.Stat(path); err != nil {
+				continue
+			}
+			signer, err := loadKey(path)
+			if err != nil {
+				c.skipped = append(c.skipped, err.Error())
+				continue
+			}
+			c.signers = append(c.signers, signer)
+		}
+	}
+	knownHosts := cfg.KnownHosts
+	if knownHosts == "" {
+		knownHosts = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeys, err := hostKeyCallback(cfg.HostKeys, knownHosts)
+	if err != nil {
+		return nil, fmt.Errorf("reading known hosts: %w", err)
+	}
+	c.hostKeys = hostKeys
+	if c.cfg.Port == 0 {
+		c.cfg.Port = 22
+	}
+	supported := make(map[string]bool)
+	for _, cipher := range append(ssh.SupportedAlgorithms().Ciphers, ssh.InsecureAlgorithms().Ciphers...) {
+		supported[cipher] = true
+	}
+	for _, cipher := range cfg.Ciphers {
+		if !supported[cipher] {
+			return nil, fmt.Errorf("unsupported cipher %q", cipher)
+		}
+	}
+	return c, nil
+}
+
+// clientConfig returns the settings to connect to t with.
+func (c *Client) clientConfig(t Target) (*ssh.ClientConfig, error) {
+	user := t.User
+	if user == "" {
+		user = c.cfg.User
+	}
+	var auth []ssh.AuthMethod
+	if t.KeyFile != "" {
+		// A key picked for the target is the only one offered
+		signer, err := c.key(t.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	} else {
+		if c.agent != nil {
+			auth = append(auth, ssh.PublicKeysCallback(c.agent.Signers))
+		}
+		if len(c.signers) > 0 {
+			auth = append(auth, ssh.PublicKeys(c.signers...))
+		}
+	}
+	if c.cfg.Password != "" {
+		auth = append(auth, ssh.Password(c.cfg.Password), ssh.KeyboardInteractive(c.answer))
+	}
+	if len(auth) == 0 {
+		why := "SSH_AUTH_SOCK is not set and there are no key files in ~/.ssh"
+		if len(c.skipped) > 0 {
+			why = "SSH_AUTH_SOCK is not set and no key file could be used: " + strings.Join(c.skipped, "; ")
+		}
+		return nil, errors.New("no usable SSH credentials: " + why)
+	}
+	config := &ssh.ClientConfig{
+		User:            user,
+		Auth:            auth,
+		HostKeyCallback: c.hostKeys,
+		Timeout:         c.cfg.ConnectTimeout,
+	}
+	config.Ciphers = c.cfg.Ciphers
+	return config, nil
+}
+
+// Credentials returns an error saying why, if the client has nothing to
+// authenticate with for targets that don't bring their own key file.
+func (c *Client) Credentials() error {
+	_, err := c.clientConfig(Target{})
+	return err
+}
+
+// key returns the signer for the key file at path, loading it the first time.
+func (c *Client) key(path string) (ssh.Signer, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if signer, ok := c.keys[path]; ok {
+		return signer, nil
+	}
+	signer, err := loadKey(path)
+	if err != nil {
+		return nil, err
+	}
+	c.keys[path] = signer
+	return signer, nil
+}
+
+// answer answers a keyboard-interactive challenge with the password, taking
+// every question that doesn't echo for a password prompt.
+func (c *Client) answer(name, instruction string, questions []string, echos []bool) ([]string, error) {
+	answers := make([]string, len(questions))
+	for i := range questions {
+		if echos[i] {
+			return nil, fmt.Errorf("keyboard-interactive asked %q, which isn't a password prompt", questions[i])
+		}
+		answers[i] = c.cfg.Password
+	}
+	return answers, nil
+}
+
+// loadKey reads the private key at path.
+func loadKey(path string) (ssh.Signer, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(pem)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		return nil, fmt.Errorf("%v is protected by a passphrase, add it to the ssh agent instead", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+	return signer, nil
+}
+
+// Options are settings for a single command.
+type Options struct {
+	Stdin io.Reader // fed to the command if not nil
+	// PTY runs the command on a pseudo-terminal, where its standard error
+	// goes to stdout
+	PTY bool
+}
+
+// Run runs command on t through the shell of the remote user, copying its
+// standard output and error to stdout and stderr, which may be the same
+// writer. Cancelling ctx closes the session. A command that ran and failed
+// returns an *ExitError; not getting that far returns a *ConnectError or an
+// *AuthError.
+func (c *Client) Run(ctx context.Context, t Target, command string, opts Options, stdout, stderr io.Writer) error {
+	host := t.Host
+	conn, err := c.connect(ctx, t)
+	if err != nil {
+		return err
+	}
+	session, err := conn.client.NewSession()
+	if err != nil && c.cfg.Reuse {
+		// The host may take fewer sessions per connection than we run over
+		// one, or have dropped the connection while we kept it
+		c.refused(t, conn)
+		if conn, err = c.connect(ctx, t); err != nil {
+			return err
+		}
+		session, err = conn.client.NewSession()
+	}
+	defer c.done(t, conn)
+	if err != nil {
+		return &ConnectError{Host: host, Err: err}
+	}
+	defer session.Close()
+	c.trace("running %q on %v", command, host)
+	stop := context.AfterFunc(ctx, func() {
+		session.Signal(ssh.SIGKILL)
+		session.Close()
+	})
+	defer stop()
+	// The session copies stdout and stderr from separate goroutines
+	var mu sync.Mutex
+	for _, kv := range c.cfg.Env {
+		key, value, _ := strings.Cut(kv, "=")
+		// Refused variables are left out, as the ssh binary does
+		session.Setenv(key, value)
+	}
+	if opts.PTY {
+		modes := ssh.TerminalModes{ssh.ECHO: 0}
+		if err := session.RequestPty("xterm", 24, 80, modes); err != nil {
+			return &ConnectError{Host: host, Err: err}
+		}
+	}
+	session.Stdin = opts.Stdin
+	session.Stdout = &lockedWriter{mu: &mu, w: stdout}
+	session.Stderr = &lockedWriter{mu: &mu, w: stderr}
+	err = session.Run(command)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		return &ExitError{Status: exitErr.ExitStatus(), Signal: exitErr.Signal()}
+	}
+	var missing *ssh.ExitMissingError
+	if errors.As(err, &missing) {
+		return &ExitError{Status: -1}
+	}
+	if err != nil {
+		return &ConnectError{Host: host, Err: err}
+	}
+	return nil
+}
+
+// connect returns a connection to t with room for another session, opening
+// one unless an open one can be reused. Each connection returned must be
+// handed back to done.
+func (c *Client) connect(ctx context.Context, t Target) (*sharedConn, error) {
+	if !c.cfg.Reuse {
+		client, closeAll, err := c.dial(ctx, t)
+		if err != nil {
+			return nil, err
+		}
+		return &sharedConn{client: client, closeAll: closeAll, sessions: 1, limit: 1}, nil
+	}
+	key := targetKey(t)
+	c.mu.Lock()
+	for {
+		var conn *sharedConn
+		for _, open := range c.conns[key] {
+			if open.sessions < open.limit {
+				conn = open
+				break
+			}
+		}
+		if conn != nil {
+			conn.sessions++
+			c.trace("reusing a connection to %v, %v sessions open", t.Host, conn.sessions)
+			c.mu.Unlock()
+			return conn, nil
+		}
+		pending := c.dialing[key]
+		if pending == nil {
+			break
+		}
+		// Let the connection being opened take us too, rather than every
+		// command starting at once opening its own
+		c.mu.Unlock()
+		select {
+		case <-pending.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if pending.err != nil {
+			return nil, pending.err
+		}
+		c.mu.Lock()
+	}
+	pending := &pendingDial{done: make(chan struct{})}
+	c.dialing[key] = pending
+	c.mu.Unlock()
+	client, closeAll, err := c.dial(ctx, t)
+	c.mu.Lock()
+	delete(c.dialing, key)
+	pending.err = err
+	close(pending.done)
+	if err != nil {
+		c.mu.Unlock()
+		return nil, err
+	}
+	conn := &sharedConn{client: client, closeAll: closeAll, sessions: 1, limit: c.cfg.MaxSessions}
+	c.conns[key] = append(c.conns[key], conn)
+	c.mu.Unlock()
+	go func() {
+		// Forget connections as soon as the host drops them
+		client.Wait()
+		c.discard(t, conn)
+	}()
+	return conn, nil
+}
+
+// done hands back conn once a session over it has ended, closing it unless
+// connections are reused.
+func (c *Client) done(t Target, conn *sharedConn) {
+	if !c.cfg.Reuse {
+		conn.closeAll()
+		return
+	}
+	c.mu.Lock()
+	conn.sessions--
+	c.mu.Unlock()
+}
+
+// refused hands back conn after it refused to open a session. The sessions
+// still running over it are left to finish, and it takes no more than those
+// from now on, which is all the host lets it have. Without any it is likely
+// to be dead, and is closed.
+func (c *Client) refused(t Target, conn *sharedConn) {
+	c.mu.Lock()
+	conn.sessions--
+	limit := conn.sessions
+	conn.limit = limit
+	c.mu.Unlock()
+	if limit == 0 {
+		c.discard(t, conn)
+		return
+	}
+	c.trace("a connection to %v takes no more than %v sessions", t.Host, limit)
+}
+
+// discard closes conn and stops reusing it.
+func (c *Client) discard(t Target, conn *sharedConn) {
+	key := targetKey(t)
+	c.mu.Lock()
+	conns := c.conns[key]
+	for i, other := range conns {
+		if other == conn {
+			c.conns[key] = append(conns[:i:i], conns[i+1:]...)
+			break
+		}
+	}
+	c.mu.Unlock()
+	c.trace("dropping a connection to %v", t.Host)
+	conn.closeAll()
+}
+
+// Close closes the connections kept open for reuse.
+func (c *Client) Close() {
+	c.mu.Lock()
+	var conns []*sharedConn
+	for _, list := range c.conns {
+		conns = append(conns, list...)
+	}
+	c.conns = make(map[string][]*sharedConn)
+	c.mu.Unlock()
+	for _, conn := range conns {
+		conn.closeAll()
+	}
+}
+
+// targetKey identifies the connection t needs: targets with the same key can
+// share one.
+func targetKey(t Target) string {
+	key := fmt.Sprintf("%v@%v:%v:%v", t.User, t.Host, t.Port, t.KeyFile)
+	for _, hop := range t.Jump {
+		key += " via " + targetKey(hop)
+	}
+	return key
+}
+
+// dial connects to t, through its jump hosts if it has any. The returned
+// function closes the connections to t and every jump host.
+func (c *Client) dial(ctx context.Context, t Target) (*ssh.Client, func(), error) {
+	var clients []*ssh.Client
+	closeAll := func() {
+		for i := len(clients) - 1; i >= 0; i-- {
+			clients[i].Close()
+		}
+	}
+	hops := append(append([]Target(nil), t.Jump...), t)
+	for _, hop := range hops {
+		config, err := c.clientConfig(hop)
+		if err != nil {
+			closeAll()
+			return nil, nil, &AuthError{Host: hop.Host, Err: err}
+		}
+		port := hop.Port
+		if port == 0 {
+			port = c.cfg.Port
+		}
+		addr := net.JoinHostPort(hop.Host, strconv.Itoa(port))
+		var conn net.Conn
+		if len(clients) == 0 {
+			dialer := net.Dialer{Timeout: config.Timeout}
+			conn, err = dialer.DialContext(ctx, "tcp", addr)
+		} else {
+			// Tunnel through the previous hop
+			conn, err = clients[len(clients)-1].DialContext(ctx, "tcp", addr)
+		}
+		if err != nil {
+			closeAll()
+			return nil, nil, &ConnectError{Host: hop.Host, Err: err}
+		}
+		sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+		if err != nil {
+			conn.Close()
+			closeAll()
+			if isAuthFailure(err) {
+				return nil, nil, &AuthError{Host: hop.Host, Err: err}
+			}
+			return nil, nil, &ConnectError{Host: hop.Host, Err: err}
+		}
+		clients = append(clients, ssh.NewClient(sshConn, chans, reqs))
+		c.trace("connected to %v as %v", addr, config.User)
+	}
+	return clients[len(clients)-1], closeAll, nil
+}
+
+func (c *Client) trace(format string, args ...interface{}) {
+	if c.cfg.Trace != nil {
+		c.cfg.Trace(format, args...)
+	}
+}
+
+// isAuthFailure reports whether a handshake error means the host turned us
+// away, rather than the connection failing.
+func isAuthFailure(err error) bool {
+	var keyErr *knownhosts.KeyError
+	if errors.As(err, &keyErr) {
+		return true
+	}
+	return strings.Contains(err.Error(), "unable to authenticate")
+}
+
+// lockedWriter serializes writes to w with other writers sharing mu.
+type lockedWriter struct {
+	mu *sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
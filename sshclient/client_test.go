@@ -0,0 +1,164 @@
+package sshclient
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// A testServer is an SSH server that lets in any user with password "pw" and
+// takes at most maxSessions sessions per connection, as sshd's MaxSessions
+// does. Commands exit 0 once release is closed.
+type testServer struct {
+	addr        *net.TCPAddr
+	maxSessions int
+	release     chan struct{}
+
+	mu      sync.Mutex
+	conns   int
+	running int
+	started chan struct{} // gets a value for every command started
+}
+
+func startTestServer(t *testing.T, maxSessions int) *testServer {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(_ ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if string(password) != "pw" {
+				return nil, &ssh.PartialSuccessError{}
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	s := &testServer{
+		addr:        l.Addr().(*net.TCPAddr),
+		maxSessions: maxSessions,
+		release:     make(chan struct{}),
+		started:     make(chan struct{}, 100),
+	}
+	go func() {
+		for {
+			nc, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(nc, config)
+		}
+	}()
+	return s
+}
+
+func (s *testServer) serve(nc net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(nc, config)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	s.conns++
+	s.mu.Unlock()
+	go ssh.DiscardRequests(reqs)
+	var mu sync.Mutex
+	sessions := 0
+	for newCh := range chans {
+		mu.Lock()
+		full := sessions >= s.maxSessions
+		if !full {
+			sessions++
+		}
+		mu.Unlock()
+		if full {
+			newCh.Reject(ssh.ResourceShortage, "no more sessions")
+			continue
+		}
+		ch, chReqs, err := newCh.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			defer func() {
+				mu.Lock()
+				sessions--
+				mu.Unlock()
+			}()
+			defer ch.Close()
+			for req := range chReqs {
+				if req.Type != "exec" {
+					req.Reply(false, nil)
+					continue
+				}
+				req.Reply(true, nil)
+				s.started <- struct{}{}
+				<-s.release
+				io.WriteString(ch, "done\n")
+				ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+				return
+			}
+		}()
+	}
+}
+
+func (s *testServer) connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conns
+}
+
+// A host that takes fewer sessions per connection than the client packs
+// onto one must get another connection, without the sessions running over
+// the first being cut off.
+func TestRunPastHostMaxSessions(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("SSH_AUTH_SOCK", "")
+	s := startTestServer(t, 2)
+	c, err := New(Config{User: "u", Port: s.addr.Port, Password: "pw", HostKeys: Off, Reuse: true, MaxSessions: 10, ConnectTimeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	const commands = 3
+	errs := make(chan error, commands)
+	for i := 0; i < commands; i++ {
+		go func() {
+			errs <- c.Run(context.Background(), Target{Host: "127.0.0.1"}, "true", Options{}, io.Discard, io.Discard)
+		}()
+		// One at a time, for the first connection to fill up first
+		select {
+		case <-s.started:
+		case err := <-errs:
+			t.Fatalf("command %v failed to start: %v", i, err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("command %v never started", i)
+		}
+	}
+	close(s.release)
+	for i := 0; i < commands; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("Run() = %v", err)
+		}
+	}
+	if n := s.connections(); n != 2 {
+		t.Errorf("opened %v connections, want 2", n)
+	}
+}
@@ -0,0 +1,53 @@
+package sshclient
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// A ConnectError means the host could not be reached or the connection was
+// lost before the command finished.
+type ConnectError struct {
+	Host string
+	Err  error
+}
+
+func (e *ConnectError) Error() string {
+	return fmt.Sprintf("connecting to %v: %v", e.Host, e.Err)
+}
+
+func (e *ConnectError) Unwrap() error { return e.Err }
+
+// Timeout reports whether the connection attempt timed out.
+func (e *ConnectError) Timeout() bool {
+	var netErr net.Error
+	return errors.As(e.Err, &netErr) && netErr.Timeout()
+}
+
+// An AuthError means the host was reached but would not let us in, or its
+// host key could not be verified.
+type AuthError struct {
+	Host string
+	Err  error
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("authenticating to %v: %v", e.Host, e.Err)
+}
+
+func (e *AuthError) Unwrap() error { return e.Err }
+
+// An ExitError means the command ran and exited with a non-zero status, or
+// was killed by a signal.
+type ExitError struct {
+	Status int    // -1 if the host didn't report one
+	Signal string // set if the command was killed by a signal
+}
+
+func (e *ExitError) Error() string {
+	if e.Signal != "" {
+		return fmt.Sprintf("remote command killed by signal %v", e.Signal)
+	}
+	return fmt.Sprintf("remote command exited with status %v", e.Status)
+}
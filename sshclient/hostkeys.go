@@ -0,0 +1,104 @@
+package sshclient
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// HostKeyChecking says what to do with host keys that aren't in the known
+// hosts file, like ssh's StrictHostKeyChecking.
+type HostKeyChecking int
+
+const (
+	// Strict refuses hosts whose key isn't known
+	Strict HostKeyChecking = iota
+	// AcceptNew adds the keys of hosts seen for the first time to the known
+	// hosts file, but still refuses hosts whose key changed
+	AcceptNew
+	// Off accepts any key without looking at the known hosts file
+	Off
+)
+
+// ParseHostKeyChecking parses strict, accept-new or off.
+func ParseHostKeyChecking(s string) (HostKeyChecking, error) {
+	switch s {
+	case "strict":
+		return Strict, nil
+	case "accept-new":
+		return AcceptNew, nil
+	case "off":
+		return Off, nil
+	}
+	return 0, fmt.Errorf("unknown host key checking %q, expected strict, accept-new or off", s)
+}
+
+// hostKeyCallback checks host keys against the known hosts file at path as
+// policy says.
+func hostKeyCallback(policy HostKeyChecking, path string) (ssh.HostKeyCallback, error) {
+	switch policy {
+	case Off:
+		return ssh.InsecureIgnoreHostKey(), nil
+	case AcceptNew:
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, err
+		}
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0600)
+		if err != nil {
+			return nil, err
+		}
+		f.Close()
+	}
+	known, err := knownhosts.New(path)
+	if err != nil {
+		return nil, err
+	}
+	if policy == Strict {
+		return known, nil
+	}
+	a := &acceptNew{path: path, known: known, accepted: make(map[string]ssh.PublicKey)}
+	return a.check, nil
+}
+
+// acceptNew is the host key callback of AcceptNew.
+type acceptNew struct {
+	path  string
+	known ssh.HostKeyCallback
+
+	mu       sync.Mutex
+	accepted map[string]ssh.PublicKey // keys added since the file was read, by host
+}
+
+func (a *acceptNew) check(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	err := a.known(hostname, remote, key)
+	var keyErr *knownhosts.KeyError
+	if !errors.As(err, &keyErr) || len(keyErr.Want) > 0 {
+		// Known, or known with a different key
+		return err
+	}
+	host := knownhosts.Normalize(hostname)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if seen, ok := a.accepted[host]; ok {
+		if string(seen.Marshal()) != string(key.Marshal()) {
+			return fmt.Errorf("host key of %v changed since it was first accepted", hostname)
+		}
+		return nil
+	}
+	f, err := os.OpenFile(a.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintln(f, knownhosts.Line([]string{host}, key)); err != nil {
+		return err
+	}
+	a.accepted[host] = key
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// streamMu keeps the lines of commands running at once from mixing on the
+// terminal
+var streamMu sync.Mutex
+
+// A lineStreamer passes what is written to it on to w a whole line at a
+// time, each line prefixed with the command and host it came from, as in
+// "[12@bigbox01] done", or its label instead of its id if it has one, and
+// with timestamps set the time the line ended
+// before that. Failing to write to w doesn't fail the command.
+type lineStreamer struct {
+	w          io.Writer
+	prefix     []byte
+	timestamps bool
+	buf        []byte // the start of a line not yet ended
+}
+
+func newLineStreamer(w io.Writer, j *job, h *host) *lineStreamer {
+	name := fmt.Sprint(j.id)
+	if j.label != "" {
+		name = j.label
+	}
+	return &lineStreamer{w: w, prefix: []byte(fmt.Sprintf("[%v@%v] ", name, h.name))}
+}
+
+func (s *lineStreamer) Write(p []byte) (int, error) {
+	s.buf = append(s.buf, p...)
+	end := bytes.LastIndexByte(s.buf, '\n')
+	if end < 0 {
+		return len(p), nil
+	}
+	var out []byte
+	for _, line := range bytes.SplitAfter(s.buf[:end+1], []byte("\n")) {
+		if len(line) > 0 {
+			out = append(s.appendPrefix(out), line...)
+		}
+	}
+	s.write(out)
+	s.buf = append(s.buf[:0], s.buf[end+1:]...)
+	return len(p), nil
+}
+
+// flush passes on the last line if the command didn't end it.
+func (s *lineStreamer) flush() {
+	if len(s.buf) == 0 {
+		return
+	}
+	s.write(append(append(s.appendPrefix(nil), s.buf...), '\n'))
+	s.buf = s.buf[:0]
+}
+
+func (s *lineStreamer) appendPrefix(out []byte) []byte {
+	if s.timestamps {
+		out = append(time.Now().AppendFormat(out, timestampLayout), ' ')
+	}
+	return append(out, s.prefix...)
+}
+
+func (s *lineStreamer) write(p []byte) {
+	streamMu.Lock()
+	defer streamMu.Unlock()
+	s.w.Write(p)
+}
+
+// A terminalWriter passes what is written to it on to w right away, for small
+// runs where the output of commands running at once mixing is no bother.
+// Failing to write to w doesn't fail the command.
+type terminalWriter struct {
+	w io.Writer
+}
+
+func (t terminalWriter) Write(p []byte) (int, error) {
+	streamMu.Lock()
+	defer streamMu.Unlock()
+	t.w.Write(p)
+	return len(p), nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// runSummary is what summary.json records about a whole run, for tools to
+// read instead of the log.
+type runSummary struct {
+	RunID     string    `json:"run_id"`
+	Started   time.Time `json:"started"`
+	Finished  time.Time `json:"finished"`
+	Duration  float64   `json:"duration_seconds"`
+	Total     int       `json:"total"`
+	Succeeded int       `json:"succeeded"`
+	Failed    int       `json:"failed"`
+	// Causes counts the commands that failed by the cause of their last
+	// failed attempt
+	Causes map[string]int `json:"causes,omitempty"`
+	// Durations are those of the attempts commands succeeded with
+	Durations *percentiles     `json:"durations,omitempty"`
+	Hosts     []hostSummary    `json:"hosts"`
+	Commands  []commandSummary `json:"commands"`
+}
+
+type percentiles struct {
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P95 float64 `json:"p95"`
+	P99 float64 `json:"p99"`
+	Max float64 `json:"max"`
+}
+
+// hostSummary sums up the attempts made on a host.
+type hostSummary struct {
+	Host     string  `json:"host"`
+	Attempts int     `json:"attempts"`
+	Failures int     `json:"failures"`
+	Busy     float64 `json:"busy_seconds"`
+	Score    float64 `json:"score,omitempty"` // as for -avoid-flaky, if it was given work this run
+}
+
+// commandSummary is how a command ended up.
+type commandSummary struct {
+	ID       int     `json:"id"`
+	Label    string  `json:"label,omitempty"`
+	Command  string  `json:"command"`
+	Status   string  `json:"status"`
+	Host     string  `json:"host,omitempty"`
+	Attempts int     `json:"attempts"`
+	Exit     *int    `json:"exit_code,omitempty"`        // of the last attempt
+	Duration float64 `json:"duration_seconds,omitempty"` // of the attempt that succeeded
+	Cause    string  `json:"cause,omitempty"`
+	Output   string  `json:"output,omitempty"` // directory of the last attempt
+}
+
+// jobStatus names how a job ended up from its final result, nil if it never
+// reported in. healthy is false if the canaries failed, so the rest of the
+// commands were never started.
+func jobStatus(r *result, healthy bool) string {
+	switch {
+	case r == nil && !healthy:
+		return "not-started"
+	case r == nil:
+		return "abandoned"
+	case r.ok:
+		return "succeeded"
+	case r.failedFast:
+		return "failed-fast"
+	case r.permanent:
+		return "permanent"
+	case r.undone:
+		return "undone"
+	}
+	return "failed"
+}
+
+// summarize sums up a run from the final results of its jobs, the metadata
+// of their attempts in t and the scores of the hosts, by name.
+func summarize(t outputTree, jobs []*job, final map[*job]*result, scores map[string]float64, healthy bool, started time.Time) *runSummary {
+	s := &runSummary{
+		RunID:    filepath.Base(t.dir),
+		Started:  started,
+		Finished: time.Now(),
+		Total:    len(jobs),
+		Causes:   make(map[string]int),
+	}
+	s.Duration = s.Finished.Sub(started).Seconds()
+	hosts := make(map[string]*hostSummary)
+	var durations []float64
+	for _, j := range jobs {
+		r := final[j]
+		c := commandSummary{ID: j.id, Label: j.label, Command: j.command, Status: jobStatus(r, healthy), Attempts: j.attempts}
+		if r != nil && r.host != nil {
+			c.Host = r.host.name
+		}
+		if r != nil && !r.ok {
+			c.Cause = r.cause
+			if c.Cause != "" {
+				s.Causes[c.Cause]++
+			}
+		}
+		if m, err := t.readCommandMeta(j.id); err == nil {
+			c.Attempts = len(m.Attempts)
+			c.Host = m.Host
+			for _, a := range m.Attempts {
+				h := hosts[a.Host]
+				if h == nil {
+					h = &hostSummary{Host: a.Host, Score: scores[a.Host]}
+					hosts[a.Host] = h
+				}
+				h.Attempts++
+				h.Busy += a.Duration
+				if !a.OK {
+					h.Failures++
+				}
+			}
+			last := m.Attempts[len(m.Attempts)-1]
+			c.Exit, c.Output = last.Exit, t.attemptDir(j.id, last.Attempt)
+			if last.OK {
+				c.Duration = last.Duration
+			}
+		}
+		if r != nil && r.ok {
+			s.Succeeded++
+			if c.Duration > 0 {
+				durations = append(durations, c.Duration)
+			}
+		}
+		s.Commands = append(s.Commands, c)
+	}
+	s.Failed = s.Total - s.Succeeded
+	if len(durations) > 0 {
+		sort.Float64s(durations)
+		s.Durations = &percentiles{
+			P50: percentile(durations, 50),
+			P90: percentile(durations, 90),
+			P95: percentile(durations, 95),
+			P99: percentile(durations, 99),
+			Max: durations[len(durations)-1],
+		}
+	}
+	for _, h := range hosts {
+		s.Hosts = append(s.Hosts, *h)
+	}
+	sort.Slice(s.Hosts, func(i, k int) bool { return s.Hosts[i].Host < s.Hosts[k].Host })
+	return s
+}
+
+// percentile returns the nearest rank p-th percentile of sorted.
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	return sorted[max(rank, 1)-1]
+}
+
+// write writes the summary to path.
+func (s *runSummary) write(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
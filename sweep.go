@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A sweepParam is a parameter of a -sweep and the values it takes.
+type sweepParam struct {
+	name   string
+	values []string
+}
+
+// parseSweep parses a -sweep of the form name=v1,v2,... where a value may be
+// a range of integers like 1..10, both ends included.
+func parseSweep(s string) (sweepParam, error) {
+	name, list, ok := strings.Cut(s, "=")
+	if !ok || name == "" || list == "" {
+		return sweepParam{}, fmt.Errorf("-sweep must look like name=v1,v2 or name=1..10, got %q", s)
+	}
+	if strings.ContainsAny(name, "{}$ \t") {
+		return sweepParam{}, fmt.Errorf("-sweep %q: bad parameter name %q", s, name)
+	}
+	switch name {
+	case "host", "id", "attempt", "outdir":
+		return sweepParam{}, fmt.Errorf("-sweep %q: {%v} is filled in when the command runs", s, name)
+	}
+	p := sweepParam{name: name}
+	for _, v := range strings.Split(list, ",") {
+		from, to, isRange := strings.Cut(v, "..")
+		if !isRange {
+			p.values = append(p.values, v)
+			continue
+		}
+		lo, err1 := strconv.Atoi(from)
+		hi, err2 := strconv.Atoi(to)
+		if err1 != nil || err2 != nil || lo > hi {
+			return sweepParam{}, fmt.Errorf("-sweep %q: ranges go from a smaller integer to a larger one, got %q", s, v)
+		}
+		for n := lo; n <= hi; n++ {
+			p.values = append(p.values, strconv.Itoa(n))
+		}
+	}
+	return p, nil
+}
+
+// sweepCombos returns every combination of the values of params, the last
+// parameter varying fastest.
+func sweepCombos(params []sweepParam) []map[string]string {
+	combos := []map[string]string{{}}
+	for _, p := range params {
+		var next []map[string]string
+		for _, c := range combos {
+			for _, v := range p.values {
+				combo := map[string]string{p.name: v}
+				for k, prev := range c {
+					combo[k] = prev
+				}
+				next = append(next, combo)
+			}
+		}
+		combos = next
+	}
+	return combos
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseSweep(t *testing.T) {
+	tests := []struct {
+		sweep string
+		name  string
+		want  []string
+	}{
+		{"mode=fast,slow", "mode", []string{"fast", "slow"}},
+		{"n=1..4", "n", []string{"1", "2", "3", "4"}},
+		{"n=0,3..5,x", "n", []string{"0", "3", "4", "5", "x"}},
+		{"n=-1..1", "n", []string{"-1", "0", "1"}},
+		{"n=7..7", "n", []string{"7"}},
+		{"q=a=b", "q", []string{"a=b"}},
+	}
+	for _, tt := range tests {
+		p, err := parseSweep(tt.sweep)
+		if err != nil {
+			t.Errorf("parseSweep(%q) = %v", tt.sweep, err)
+			continue
+		}
+		if p.name != tt.name || strings.Join(p.values, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("parseSweep(%q) = %v %v, want %v %v", tt.sweep, p.name, p.values, tt.name, tt.want)
+		}
+	}
+}
+
+func TestParseSweepErrors(t *testing.T) {
+	tests := []struct {
+		sweep string
+		want  string
+	}{
+		{"mode", "must look like name=v1,v2"},
+		{"=a,b", "must look like name=v1,v2"},
+		{"mode=", "must look like name=v1,v2"},
+		{"my mode=a", `bad parameter name "my mode"`},
+		{"{n}=1", "bad parameter name"},
+		{"host=a,b", "{host} is filled in when the command runs"},
+		{"attempt=1..3", "{attempt} is filled in when the command runs"},
+		{"n=5..1", `ranges go from a smaller integer to a larger one, got "5..1"`},
+		{"n=a..c", "ranges go from a smaller integer"},
+	}
+	for _, tt := range tests {
+		if _, err := parseSweep(tt.sweep); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("parseSweep(%q) = %v, want an error with %q", tt.sweep, err, tt.want)
+		}
+	}
+}
+
+func TestSweepCombos(t *testing.T) {
+	params := []sweepParam{{"a", []string{"1", "2"}}, {"b", []string{"x", "y", "z"}}}
+	var got []string
+	for _, c := range sweepCombos(params) {
+		got = append(got, c["a"]+c["b"])
+	}
+	want := "1x 1y 1z 2x 2y 2z"
+	if strings.Join(got, " ") != want {
+		t.Errorf("sweepCombos() = %v, want %v", got, want)
+	}
+	if combos := sweepCombos(nil); len(combos) != 1 || len(combos[0]) != 0 {
+		t.Errorf("sweepCombos(nil) = %v, want a single empty combination", combos)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// openSyslog fails, there being no syslog here.
+func openSyslog(addr, tag string) error {
+	return fmt.Errorf("syslog isn't available on %v", runtime.GOOS)
+}
+
+func logSyslog(level int, format string, args ...interface{}) {}
@@ -0,0 +1,47 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"log/syslog"
+	"strings"
+)
+
+// syslogWriter, if set, gets every message logged as well
+var syslogWriter *syslog.Writer
+
+// openSyslog sends messages to the syslog daemon at addr as well: "local"
+// for this machine's, or [udp://|tcp://]host:port for a remote one, UDP by
+// default.
+func openSyslog(addr, tag string) error {
+	network, raddr := "udp", addr
+	switch {
+	case addr == "local":
+		network, raddr = "", ""
+	case strings.HasPrefix(addr, "udp://"), strings.HasPrefix(addr, "tcp://"):
+		network, raddr = addr[:3], addr[len("udp://"):]
+	}
+	w, err := syslog.Dial(network, raddr, syslog.LOG_USER|syslog.LOG_INFO, tag)
+	if err != nil {
+		return fmt.Errorf("could not reach syslog at %v: %v", addr, err)
+	}
+	syslogWriter = w
+	return nil
+}
+
+// logSyslog passes a message logged at level on to syslog, if it is open.
+func logSyslog(level int, format string, args ...interface{}) {
+	if syslogWriter == nil {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	switch level {
+	case levelError:
+		syslogWriter.Err(msg)
+	case levelInfo:
+		syslogWriter.Info(msg)
+	default:
+		syslogWriter.Debug(msg)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A tagSet holds the labels a host carries.
+type tagSet map[string]bool
+
+// parseTagList splits a comma separated list of tags, e.g. "gpu,ssd".
+func parseTagList(value string) ([]string, error) {
+	var tags []string
+	for _, tag := range strings.Split(value, ",") {
+		if name := strings.TrimPrefix(tag, "!"); name == "" {
+			return nil, fmt.Errorf("empty tag in %q", value)
+		}
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
+
+// satisfies reports whether labels meet every requirement. A requirement is
+// either a label the host must carry, or a label prefixed with "!" that the
+// host must not carry.
+func (labels tagSet) satisfies(requires []string) bool {
+	for _, req := range requires {
+		if strings.HasPrefix(req, "!") {
+			if labels[req[1:]] {
+				return false
+			}
+		} else if !labels[req] {
+			return false
+		}
+	}
+	return true
+}
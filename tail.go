@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How often tail looks for more output
+const tailPoll = 250 * time.Millisecond
+
+// latestRun returns the name of the run in dir that was written to last.
+func latestRun(dir string) (string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	var latest string
+	var latestTime time.Time
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		if latest == "" || info.ModTime().After(latestTime) {
+			latest, latestTime = e.Name(), info.ModTime()
+		}
+	}
+	if latest == "" {
+		return "", fmt.Errorf("no runs in %v", dir)
+	}
+	return latest, nil
+}
+
+// latestAttempt returns the number of the last attempt of command id that
+// has a directory, or -1 if there is none yet.
+func (t outputTree) latestAttempt(id int) int {
+	dirs, _ := filepath.Glob(filepath.Join(t.commandDir(id), "attempt-*"))
+	latest := -1
+	for _, dir := range dirs {
+		n, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(dir), "attempt-"))
+		if err == nil && n > latest {
+			latest = n
+		}
+	}
+	return latest
+}
+
+// finished reports whether command id is done with attempt, so there will be
+// no more output from it and no attempt after it.
+func (t outputTree) finished(id, attempt int) bool {
+	m, err := t.readCommandMeta(id)
+	return err == nil && len(m.Attempts) > 0 && m.Attempts[len(m.Attempts)-1].Attempt == attempt
+}
+
+// ended reports whether the run in t is over, which it is once it wrote its
+// summary. A summary left by an earlier run with the same id doesn't count.
+func (t outputTree) ended() bool {
+	data, err := os.ReadFile(filepath.Join(t.dir, "summary.json"))
+	if err != nil {
+		return false
+	}
+	var s runSummary
+	if json.Unmarshal(data, &s) != nil {
+		return false
+	}
+	r, err := t.readRunMeta()
+	return err != nil || !s.Started.Before(r.Started)
+}
+
+// A follower copies what is added to a file to w as it grows.
+type follower struct {
+	path string
+	w    io.Writer
+	f    *os.File
+}
+
+// poll copies what was added to the file since the last call, opening it
+// once it exists.
+func (f *follower) poll() {
+	if f.f == nil {
+		file, err := os.Open(f.path)
+		if err != nil {
+			return
+		}
+		f.f = file
+	}
+	io.Copy(f.w, f.f)
+}
+
+func (f *follower) close() {
+	if f.f != nil {
+		f.f.Close()
+	}
+}
+
+// tailCommand follows the output of command id of the run in t, from its
+// latest attempt on, until the command is done with it, waiting for it to
+// start if it hasn't. Attempts that start afterwards are followed in turn.
+// It gives up once the run is over.
+func tailCommand(t outputTree, id int) error {
+	if _, err := os.Stat(t.dir); err != nil {
+		return err
+	}
+	if r, err := t.readRunMeta(); err == nil && !r.Watch && (id < 0 || id >= r.Commands) {
+		return fmt.Errorf("%v has no command %v, its ids go from 0 to %v", t.dir, id, r.Commands-1)
+	}
+	if t.latestAttempt(id) < 0 {
+		fmt.Fprintf(os.Stderr, "waiting for command %v of %v to start\n", id, t.dir)
+	}
+	for {
+		attempt := t.latestAttempt(id)
+		if attempt < 0 {
+			if t.ended() {
+				return fmt.Errorf("the run in %v is over and command %v never started", t.dir, id)
+			}
+			time.Sleep(tailPoll)
+			continue
+		}
+		dir := t.attemptDir(id, attempt)
+		if _, err := os.Stat(filepath.Join(dir, "stdout.gz")); err == nil {
+			return fmt.Errorf("the output in %v is compressed, which can't be followed", dir)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "output.gz")); err == nil {
+			return fmt.Errorf("the output in %v is compressed, which can't be followed", dir)
+		}
+		fmt.Fprintf(os.Stderr, "==> %v <==\n", dir)
+		followers := []*follower{
+			{path: filepath.Join(dir, "stdout"), w: os.Stdout},
+			{path: filepath.Join(dir, "stderr"), w: os.Stderr},
+			{path: filepath.Join(dir, "output"), w: os.Stdout},
+		}
+		ended := false
+		for !t.finished(id, attempt) && t.latestAttempt(id) == attempt && !ended {
+			ended = t.ended()
+			for _, f := range followers {
+				f.poll()
+			}
+			time.Sleep(tailPoll)
+		}
+		// Whatever came in before the attempt was done
+		for _, f := range followers {
+			f.poll()
+			f.close()
+		}
+		if t.finished(id, attempt) {
+			return nil
+		}
+		if ended {
+			return fmt.Errorf("the run in %v is over and command %v never finished", t.dir, id)
+		}
+	}
+}
+
+// runTail is disgo tail <cmd-id>: it follows the output of a command of the
+// run named by -run-id in -output-dir, or of the latest run there. The
+// command can be named by its label as well.
+func runTail(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: disgo [-output-dir dir] [-run-id id] tail <cmd-id|label>")
+	}
+	run := runID
+	if run == "" {
+		var err error
+		if run, err = latestRun(outputDir); err != nil {
+			return err
+		}
+	}
+	t := outputTree{dir: filepath.Join(outputDir, run)}
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		target, err := os.Readlink(filepath.Join(t.dir, "by-label", pathSafe(args[0])))
+		if err != nil {
+			return fmt.Errorf("no command labelled %q in %v", args[0], t.dir)
+		}
+		id, _ = strconv.Atoi(filepath.Base(target))
+	}
+	return tailCommand(t, id)
+}
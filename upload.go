@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Files copied to object storage at once
+const uploadWorkers = 4
+
+// An uploader copies output files to object storage under dest, an
+// s3://bucket/prefix or gs://bucket/prefix URL, through the aws or gsutil
+// command line tools, so that they outlive the machine the run is on. Files
+// keep their path under root. Uploads happen in the background; a nil
+// uploader uploads nothing.
+type uploader struct {
+	dest  string
+	root  string
+	files chan uploadFile
+	wg    sync.WaitGroup
+
+	mu       sync.Mutex
+	uploaded int
+	failed   int
+}
+
+// An uploadFile is a file to upload and where under root it goes.
+type uploadFile struct {
+	path, as string
+}
+
+func newUploader(dest, root string) (*uploader, error) {
+	if !strings.HasPrefix(dest, "s3://") && !strings.HasPrefix(dest, "gs://") {
+		return nil, fmt.Errorf("-upload must be an s3:// or gs:// URL, got %q", dest)
+	}
+	u := &uploader{dest: strings.TrimSuffix(dest, "/"), root: root, files: make(chan uploadFile, 1024)}
+	for i := 0; i < uploadWorkers; i++ {
+		u.wg.Add(1)
+		go u.work()
+	}
+	return u, nil
+}
+
+// upload queues the file at path to be copied.
+func (u *uploader) upload(path string) {
+	u.uploadAs(path, path)
+}
+
+// uploadAs queues the file at path to be copied as if it were at as, for
+// files kept outside root.
+func (u *uploader) uploadAs(path, as string) {
+	if u == nil {
+		return
+	}
+	u.files <- uploadFile{path, as}
+}
+
+// uploadDir queues the regular files directly in dir to be copied.
+func (u *uploader) uploadDir(dir string) {
+	if u == nil {
+		return
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		logError("ERROR could not list %v to upload: %v", dir, err)
+		return
+	}
+	for _, e := range entries {
+		if e.Type().IsRegular() {
+			u.upload(filepath.Join(dir, e.Name()))
+		}
+	}
+}
+
+// wait waits for everything queued to be copied and reports how it went.
+func (u *uploader) wait() {
+	if u == nil {
+		return
+	}
+	close(u.files)
+	u.wg.Wait()
+	logInfo("UPLOAD dest=%v uploaded=%v failed=%v", u.dest, u.uploaded, u.failed)
+}
+
+func (u *uploader) work() {
+	defer u.wg.Done()
+	for f := range u.files {
+		err := u.copy(f.path, f.as)
+		u.mu.Lock()
+		if err != nil {
+			u.failed++
+		} else {
+			u.uploaded++
+		}
+		u.mu.Unlock()
+		if err != nil {
+			logError("ERROR could not upload %v: %v", f.path, err)
+		}
+	}
+}
+
+// copy copies the file at path to object storage, where it goes by its path
+// as.
+func (u *uploader) copy(path, as string) error {
+	rel, err := filepath.Rel(u.root, as)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return fmt.Errorf("not in %v", u.root)
+	}
+	dst := u.dest + "/" + filepath.ToSlash(rel)
+	var cmd *exec.Cmd
+	if strings.HasPrefix(u.dest, "s3://") {
+		cmd = exec.Command("aws", "s3", "cp", "--only-show-errors", path, dst)
+	} else {
+		cmd = exec.Command("gsutil", "-q", "cp", path, dst)
+	}
+	logTrace("UPLOAD args=%q", cmd.Args)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %v", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
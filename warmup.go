@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// Runs on any host that gets as far as running a command, whatever its shell
+const probeCommand = "exit 0"
+
+// warmUp connects to every host in parallel before anything is dispatched,
+// so the connections kept for reuse are already open, and logs which hosts
+// could be reached within timeout. It returns how many could. Unreachable
+// hosts stay in the pool, where they are retried as usual.
+func warmUp(hosts []*host, timeout time.Duration) int {
+	var mu sync.Mutex
+	reached := 0
+	var wg sync.WaitGroup
+	for _, h := range hosts {
+		wg.Add(1)
+		go func(h *host) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			start := time.Now()
+			err := tryCommand(ctx, probeCommand, h, io.Discard)
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
+			if unreachable(err) {
+				logInfo("WARMUP host=%v unreachable: %v", h.name, err)
+				return
+			}
+			logDetail("WARMUP host=%v reached in %v", h.name, time.Since(start).Round(time.Millisecond))
+			mu.Lock()
+			reached++
+			mu.Unlock()
+		}(h)
+	}
+	wg.Wait()
+	logInfo("WARMUP %v of %v hosts reachable", reached, len(hosts))
+	return reached
+}
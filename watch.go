@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// How often -watch looks for lines appended to the commands files
+const watchPoll = time.Second
+
+// A commandsWatch follows a commands file for -watch, reading the lines
+// appended to it. Lines are only taken once they end in a newline, so one
+// that is still being written waits for the next read.
+type commandsWatch struct {
+	path   string
+	offset int64 // bytes read so far
+	lines  int   // lines read so far
+}
+
+// read returns the lines appended to the file since the last read.
+func (w *commandsWatch) read() ([]string, error) {
+	f, err := os.Open(w.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < w.offset {
+		logError("WARNING %v got shorter, only watching for lines appended from now on", w.path)
+		w.offset = info.Size()
+		return nil, nil
+	}
+	if _, err := f.Seek(w.offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	end := bytes.LastIndexByte(data, '\n')
+	if end < 0 {
+		return nil, nil
+	}
+	w.offset += int64(end + 1)
+	lines := strings.Split(string(data[:end]), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSuffix(line, "\r")
+	}
+	w.lines += len(lines)
+	return lines, nil
+}
+
+// watchCommands reads the lines appended to the files of watches every
+// watchPoll and sends the jobs parse makes of them, until stop is closed or
+// stopped returns true, then closes the channel it returns. parse is given
+// the file and the number of the first line, and may return no jobs.
+func watchCommands(watches []*commandsWatch, parse func(path string, firstLine int, lines []string) []*job, stop <-chan struct{}, stopped func() bool) <-chan []*job {
+	more := make(chan []*job)
+	go func() {
+		defer close(more)
+		ticker := time.NewTicker(watchPoll)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			if stopped() {
+				return
+			}
+			for _, w := range watches {
+				firstLine := w.lines + 1
+				lines, err := w.read()
+				if err != nil {
+					logError("ERROR could not read %v for -watch: %v", w.path, err)
+					continue
+				}
+				if jobs := parse(w.path, firstLine, lines); len(jobs) > 0 {
+					select {
+					case more <- jobs:
+					case <-stop:
+						return
+					}
+				}
+			}
+		}
+	}()
+	return more
+}
+
+// watchStop returns a channel that is closed once disgo is interrupted or
+// told to terminate, which ends -watch. The commands already queued still
+// run; a second interrupt kills disgo as usual.
+func watchStop() <-chan struct{} {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	stop := make(chan struct{})
+	go func() {
+		<-sig
+		signal.Stop(sig)
+		logInfo("WATCH stopped, finishing the commands already queued")
+		close(stop)
+	}()
+	return stop
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/a10y/disgo/winrm"
+)
+
+// Host name prefixes of Windows hosts, reached over WinRM with HTTP on port
+// 5985 or HTTPS on port 5986 by default, e.g. winrms://admin@build-win:5986
+const (
+	winrmScheme  = "winrm://"
+	winrmsScheme = "winrms://"
+)
+
+// parseWinRM sets up h to be reached over WinRM at addr, [user@]host[:port],
+// with HTTPS if secure is set.
+func (h *host) parseWinRM(addr string, secure bool) error {
+	if err := h.parseAddress(addr); err != nil {
+		return err
+	}
+	h.winrm = "http"
+	if secure {
+		h.winrm = "https"
+	}
+	return nil
+}
+
+// winrmEndpoint returns the URL of the WinRM service of h.
+func (h *host) winrmEndpoint() string {
+	port := h.port
+	if port == 0 {
+		port = 5985
+		if h.winrm == "https" {
+			port = 5986
+		}
+	}
+	return fmt.Sprintf("%v://%v/wsman", h.winrm, net.JoinHostPort(h.name, strconv.Itoa(port)))
+}
+
+// winrmExecutor runs commands through cmd.exe on Windows hosts, logging in
+// with the password given for ssh.
+type winrmExecutor struct{}
+
+func (winrmExecutor) run(ctx context.Context, h *host, command string, opts runOptions, stdout, stderr io.Writer) (exitStatus, error) {
+	// WinRM shells have no terminals, opts.pty can only be ignored
+	client := &winrm.Client{Endpoint: h.winrmEndpoint(), User: h.user, Password: sshPassword, Env: commandEnv}
+	if tracing() {
+		client.Trace = func(format string, args ...interface{}) {
+			logTrace("WINRM host=%v %v", h.name, fmt.Sprintf(format, args...))
+		}
+	}
+	err := client.Run(ctx, command, stdout, stderr)
+	var exitErr *winrm.ExitError
+	if errors.As(err, &exitErr) {
+		return exitStatus(exitErr.Status), nil
+	}
+	return 0, err
+}
@@ -0,0 +1,220 @@
+// Package winrm runs commands on Windows hosts over WinRM, the WS-Management
+// remote shell protocol, with HTTP basic authentication. It implements just
+// what running a command needs: open a shell, run the command in it, read
+// its output until it exits, and close the shell.
+package winrm
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	actionCreate  = "http://schemas.xmlsoap.org/ws/2004/09/transfer/Create"
+	actionDelete  = "http://schemas.xmlsoap.org/ws/2004/09/transfer/Delete"
+	actionCommand = "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/Command"
+	actionReceive = "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/Receive"
+	actionSignal  = "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/Signal"
+
+	resourceCmd = "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/cmd"
+	stateDone   = "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/CommandState/Done"
+	signalStop  = "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/signal/terminate"
+
+	// Fault code of a Receive that saw no output within the operation
+	// timeout, which just means to ask again
+	codeTimedOut = "2150858793"
+)
+
+// How long the host may hold a Receive before answering that there's no
+// output yet
+const operationTimeout = 60 * time.Second
+
+// A Client runs commands on one Windows host.
+type Client struct {
+	Endpoint string // e.g. https://host:5986/wsman
+	User     string
+	Password string
+	HTTP     *http.Client // http.DefaultClient if nil
+	Env      []string     // KEY=VALUE pairs to set in the environment of commands
+	// Trace, if set, is called with a message for every request made
+	Trace func(format string, args ...interface{})
+}
+
+// Run runs command through cmd.exe on the host, copying its standard output
+// and error to stdout and stderr. Cancelling ctx stops the command. A command
+// that ran and failed returns an *ExitError, one the host wouldn't let us run
+// an *AuthError.
+func (c *Client) Run(ctx context.Context, command string, stdout, stderr io.Writer) error {
+	var created struct {
+		ShellID string `xml:"Body>Shell>ShellId"`
+	}
+	options := map[string]string{"WINRS_NOPROFILE": "FALSE", "WINRS_CODEPAGE": "65001"}
+	var env strings.Builder
+	if len(c.Env) > 0 {
+		env.WriteString(`<rsp:Environment>`)
+		for _, kv := range c.Env {
+			key, value, _ := strings.Cut(kv, "=")
+			fmt.Fprintf(&env, `<rsp:Variable Name="%v">%v</rsp:Variable>`, escape(key), escape(value))
+		}
+		env.WriteString(`</rsp:Environment>`)
+	}
+	body := `<rsp:Shell>` + env.String() + `<rsp:InputStreams>stdin</rsp:InputStreams><rsp:OutputStreams>stdout stderr</rsp:OutputStreams></rsp:Shell>`
+	if err := c.call(ctx, actionCreate, "", options, body, &created); err != nil {
+		return err
+	}
+	shell := created.ShellID
+	defer func() {
+		// The shell outlives the command unless deleted, even if ctx is done
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		c.call(ctx, actionDelete, shell, nil, "", nil)
+	}()
+
+	var started struct {
+		CommandID string `xml:"Body>CommandResponse>CommandId"`
+	}
+	options = map[string]string{"WINRS_CONSOLEMODE_STDIN": "TRUE", "WINRS_SKIP_CMD_SHELL": "FALSE"}
+	body = fmt.Sprintf(`<rsp:CommandLine><rsp:Command>%v</rsp:Command></rsp:CommandLine>`, escape(command))
+	if err := c.call(ctx, actionCommand, shell, options, body, &started); err != nil {
+		return err
+	}
+	id := started.CommandID
+	stop := context.AfterFunc(ctx, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		body := fmt.Sprintf(`<rsp:Signal CommandId="%v"><rsp:Code>%v</rsp:Code></rsp:Signal>`, escape(id), signalStop)
+		c.call(ctx, actionSignal, shell, nil, body, nil)
+	})
+	defer stop()
+
+	body = fmt.Sprintf(`<rsp:Receive><rsp:DesiredStream CommandId="%v">stdout stderr</rsp:DesiredStream></rsp:Receive>`, escape(id))
+	for {
+		var received struct {
+			Streams []struct {
+				Name string `xml:"Name,attr"`
+				Data string `xml:",chardata"`
+			} `xml:"Body>ReceiveResponse>Stream"`
+			State struct {
+				State    string `xml:"State,attr"`
+				ExitCode int    `xml:"ExitCode"`
+			} `xml:"Body>ReceiveResponse>CommandState"`
+		}
+		err := c.call(ctx, actionReceive, shell, nil, body, &received)
+		if f, ok := err.(*fault); ok && f.Code == codeTimedOut {
+			continue
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		for _, s := range received.Streams {
+			data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s.Data))
+			if err != nil {
+				return fmt.Errorf("bad %v from %v: %w", s.Name, c.Endpoint, err)
+			}
+			w := stdout
+			if s.Name == "stderr" {
+				w = stderr
+			}
+			w.Write(data)
+		}
+		if received.State.State == stateDone {
+			if received.State.ExitCode != 0 {
+				return &ExitError{Status: received.State.ExitCode}
+			}
+			return nil
+		}
+	}
+}
+
+// call sends a WS-Management request with action to the host and decodes
+// the response envelope into out, unless it is nil. Requests other than
+// Create address the shell with id shell.
+func (c *Client) call(ctx context.Context, action, shell string, options map[string]string, body string, out any) error {
+	var header strings.Builder
+	fmt.Fprintf(&header, `<a:To>%v</a:To>`, escape(c.Endpoint))
+	header.WriteString(`<a:ReplyTo><a:Address mustUnderstand="true">http://schemas.xmlsoap.org/ws/2004/08/addressing/role/anonymous</a:Address></a:ReplyTo>`)
+	header.WriteString(`<w:MaxEnvelopeSize mustUnderstand="true">153600</w:MaxEnvelopeSize>`)
+	fmt.Fprintf(&header, `<a:MessageID>uuid:%v</a:MessageID>`, uuid())
+	header.WriteString(`<w:Locale mustUnderstand="false" xml:lang="en-US"/>`)
+	fmt.Fprintf(&header, `<w:OperationTimeout>PT%vS</w:OperationTimeout>`, int(operationTimeout/time.Second))
+	fmt.Fprintf(&header, `<w:ResourceURI mustUnderstand="true">%v</w:ResourceURI>`, resourceCmd)
+	fmt.Fprintf(&header, `<a:Action mustUnderstand="true">%v</a:Action>`, action)
+	if shell != "" {
+		fmt.Fprintf(&header, `<w:SelectorSet><w:Selector Name="ShellId">%v</w:Selector></w:SelectorSet>`, escape(shell))
+	}
+	if len(options) > 0 {
+		header.WriteString(`<w:OptionSet>`)
+		for name, value := range options {
+			fmt.Fprintf(&header, `<w:Option Name="%v">%v</w:Option>`, name, value)
+		}
+		header.WriteString(`</w:OptionSet>`)
+	}
+	envelope := `<env:Envelope xmlns:env="http://www.w3.org/2003/05/soap-envelope"` +
+		` xmlns:a="http://schemas.xmlsoap.org/ws/2004/08/addressing"` +
+		` xmlns:w="http://schemas.dmtf.org/wbem/wsman/1/wsman.xsd"` +
+		` xmlns:rsp="http://schemas.microsoft.com/wbem/wsman/1/windows/shell">` +
+		`<env:Header>` + header.String() + `</env:Header><env:Body>` + body + `</env:Body></env:Envelope>`
+
+	req, err := http.NewRequestWithContext(ctx, "POST", c.Endpoint, strings.NewReader(envelope))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/soap+xml;charset=UTF-8")
+	req.SetBasicAuth(c.User, c.Password)
+	client := c.HTTP
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if c.Trace != nil {
+		c.Trace("%v %v answered %v", action[strings.LastIndex(action, "/")+1:], c.Endpoint, resp.Status)
+	}
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		return &AuthError{Endpoint: c.Endpoint, Status: resp.Status}
+	case resp.StatusCode != http.StatusOK:
+		if f := parseFault(data); f != nil {
+			return f
+		}
+		return fmt.Errorf("%v answered %v", c.Endpoint, resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return xml.Unmarshal(data, out)
+}
+
+// escape escapes s for use in XML text and attributes.
+func escape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// uuid returns a random UUID for a message ID.
+func uuid() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,53 @@
+package winrm
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+)
+
+// An AuthError means the host turned down our user and password.
+type AuthError struct {
+	Endpoint string
+	Status   string
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("%v turned down our credentials: %v", e.Endpoint, e.Status)
+}
+
+// An ExitError means the command ran and exited with a non-zero status.
+type ExitError struct {
+	Status int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("remote command exited with status %v", e.Status)
+}
+
+// A fault is a SOAP fault the host answered with.
+type fault struct {
+	Code   string
+	Reason string
+}
+
+// parseFault reads the fault in a response envelope, or returns nil if there
+// isn't one.
+func parseFault(data []byte) *fault {
+	var envelope struct {
+		Fault struct {
+			Reason string `xml:"Reason>Text"`
+			Detail struct {
+				Code string `xml:"Code,attr"`
+			} `xml:"Detail>WSManFault"`
+		} `xml:"Body>Fault"`
+	}
+	if xml.Unmarshal(data, &envelope) != nil || envelope.Fault.Detail.Code == "" {
+		return nil
+	}
+	return &fault{Code: envelope.Fault.Detail.Code, Reason: strings.TrimSpace(envelope.Fault.Reason)}
+}
+
+func (f *fault) Error() string {
+	return fmt.Sprintf("WinRM fault %v: %v", f.Code, f.Reason)
+}